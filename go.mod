@@ -3,6 +3,7 @@ module github.com/hidu/proxy-manager
 go 1.26.1
 
 require (
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/shadowsocks/go-shadowsocks2 v0.1.5
 	github.com/xanygo/anygo v0.0.0-20260415121209-00757e152a0e
 	github.com/xanygo/ext v0.0.0-20260228134916-3cc748f50bb3
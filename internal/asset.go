@@ -27,6 +27,7 @@ func init() {
 			}
 			return str
 		},
+		"my_bytes": formatBytes,
 	}).ParseFS(files, "asset/tpl/*"))
 }
 
@@ -42,3 +43,20 @@ func renderHTML(fileName string, values map[string]any, layout bool) []byte {
 	values["body"] = w.String()
 	return renderHTML("layout.html", values, false)
 }
+
+// formatBytes 将字节数格式化为易读的形式，如 1.5 MB，0 时返回空
+func formatBytes(num int64) string {
+	if num == 0 {
+		return ""
+	}
+	const unit = 1024
+	if num < unit {
+		return fmt.Sprintf("%d B", num)
+	}
+	div, exp := int64(unit), 0
+	for n := num / unit; n >= unit && exp < 4; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(num)/float64(div), "KMGTP"[exp])
+}
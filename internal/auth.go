@@ -20,6 +20,21 @@ type User struct {
 	Password    string `yaml:"Password"`
 	PasswordMd5 string `yaml:"PasswordMd5"`
 	Admin       bool   `yaml:"Admin"`
+
+	// 是否解密该用户的 HTTPS 请求，解密后的请求和 HTTP 请求一样处理，客户端需要信任 CA 证书
+	MITM bool `yaml:"MITM"`
+
+	// CONNECT 隧道的超时配置，可选，优先于 app.yml 中的配置
+	tunnelTimeoutConfig `yaml:",inline"`
+
+	// 限速和流量配额，可选
+	userLimitConfig `yaml:",inline"`
+
+	// 并发数和请求频率的限制，可选，未配置时使用 app.yml 中的 Limits.User
+	requestLimitConfig `yaml:",inline"`
+
+	// 代理请求时，从代理用户名中解析出的路由参数
+	Options userOptions `yaml:"-" json:"-"`
 }
 
 func (u *User) pswEq(psw string) bool {
@@ -53,7 +68,13 @@ func getProxyAuthorInfo(req *http.Request) *User {
 	if len(userPass) != 2 {
 		return defaultInfo
 	}
-	return &User{Name: userPass[0], PasswordMd5: StrMd5(userPass[1])}
+	user := &User{Name: userPass[0], PasswordMd5: StrMd5(userPass[1])}
+	// 用户名本身就是已配置的用户时，不解析参数
+	if authType() == AuthTypeBasic && getUser(user.Name) != nil {
+		return user
+	}
+	user.Name, user.Options = parseProxyUserName(user.Name)
+	return user
 }
 
 type userConfig struct {
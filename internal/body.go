@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xio/xfs"
+)
+
+var (
+	errBodyNotReplayable = errors.New("request body too large to replay, retry disabled")
+	errRequestTooLarge   = errors.New("request body too large")
+	errResponseTooLarge  = errors.New("response body too large")
+)
+
+// newReplayBody 读取客户端请求的 Body，若请求没有 Body，返回 nil
+func newReplayBody(w http.ResponseWriter, req *http.Request) (*replayBody, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+		return nil, nil
+	}
+	var src io.Reader = req.Body
+	if num := getMaxRequestSize(); num > 0 {
+		if req.ContentLength > num {
+			return nil, errRequestTooLarge
+		}
+		src = http.MaxBytesReader(w, req.Body, num)
+	}
+	rb := &replayBody{
+		src:      src,
+		memLimit: getReplayMemorySize(),
+		maxSize:  getReplayBufferSize(),
+	}
+	return rb, nil
+}
+
+// replayBody 流式的读取请求 Body，同时将已读取的内容缓存下来，以便重试时可以重放。
+// 缓存先写入内存，超过 memLimit 后写入临时文件，总长度超过 maxSize 后放弃缓存，之后不能再重放。
+// 同一时间只允许一个 Reader 读取。
+type replayBody struct {
+	src      io.Reader
+	memLimit int64
+	maxSize  int64
+
+	mux      sync.Mutex
+	mem      bytes.Buffer
+	file     *os.File
+	read     int64 // 已从 src 读取的长度
+	srcErr   error // src 返回的错误，包括 io.EOF
+	overflow bool  // 已超过 maxSize，缓存已丢弃
+}
+
+// Reader 返回一个新的 Reader: 先重放已缓存的内容，之后继续从 src 读取
+func (rb *replayBody) Reader() (io.ReadCloser, error) {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	if rb.overflow {
+		return nil, errBodyNotReplayable
+	}
+	return &replayReader{rb: rb}, nil
+}
+
+// Buffered 是否已完整读取并缓存了 Body
+func (rb *replayBody) Buffered() bool {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	return !rb.overflow && errors.Is(rb.srcErr, io.EOF)
+}
+
+// ReadAll 读取并缓存完整的 Body，若超过缓存上限返回 errBodyNotReplayable
+func (rb *replayBody) ReadAll() error {
+	rd, err := rb.Reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, rd)
+	if err != nil {
+		return err
+	}
+	if !rb.Buffered() {
+		return errBodyNotReplayable
+	}
+	return nil
+}
+
+// TooLarge 请求 Body 是否超过了 MaxRequestSize 的限制
+func (rb *replayBody) TooLarge() bool {
+	if rb == nil {
+		return false
+	}
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	var me *http.MaxBytesError
+	return errors.As(rb.srcErr, &me)
+}
+
+// Size 已从客户端读取的 Body 长度
+func (rb *replayBody) Size() int64 {
+	if rb == nil {
+		return 0
+	}
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	return rb.read
+}
+
+func (rb *replayBody) Close() error {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+	rb.dropCache()
+	return nil
+}
+
+func (rb *replayBody) dropCache() {
+	rb.mem = bytes.Buffer{}
+	if rb.file != nil {
+		rb.file.Close()
+		os.Remove(rb.file.Name())
+		rb.file = nil
+	}
+}
+
+func (rb *replayBody) cache(bf []byte) {
+	if rb.overflow {
+		return
+	}
+	if rb.read+int64(len(bf)) > rb.maxSize {
+		rb.overflow = true
+		rb.dropCache()
+		return
+	}
+	if free := rb.memLimit - int64(rb.mem.Len()); free > 0 {
+		n := min(free, int64(len(bf)))
+		rb.mem.Write(bf[:n])
+		bf = bf[n:]
+	}
+	if len(bf) == 0 {
+		return
+	}
+	if rb.file == nil {
+		dir := xattr.TempDir()
+		xfs.KeepDirExists(dir)
+		f, err := os.CreateTemp(dir, "body-*")
+		if err != nil {
+			rb.overflow = true
+			rb.dropCache()
+			return
+		}
+		rb.file = f
+	}
+	if _, err := rb.file.Write(bf); err != nil {
+		rb.overflow = true
+		rb.dropCache()
+	}
+}
+
+func (rb *replayBody) readCache(p []byte, pos int64) (int, error) {
+	memLen := int64(rb.mem.Len())
+	if pos < memLen {
+		return copy(p, rb.mem.Bytes()[pos:]), nil
+	}
+	limit := min(int64(len(p)), rb.read-pos)
+	n, err := rb.file.ReadAt(p[:limit], pos-memLen)
+	if n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+type replayReader struct {
+	rb  *replayBody
+	pos int64
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	rb := r.rb
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+
+	if r.pos < rb.read {
+		if rb.overflow {
+			return 0, errBodyNotReplayable
+		}
+		n, err := rb.readCache(p, r.pos)
+		r.pos += int64(n)
+		return n, err
+	}
+	if rb.srcErr != nil {
+		return 0, rb.srcErr
+	}
+	n, err := rb.src.Read(p)
+	if n > 0 {
+		rb.cache(p[:n])
+		rb.read += int64(n)
+		r.pos += int64(n)
+	}
+	if err != nil {
+		rb.srcErr = err
+	}
+	return n, err
+}
+
+// Close 不关闭 src，src 由 replayBody.Close 负责清理
+func (r *replayReader) Close() error {
+	return nil
+}
+
+// limitReader 和 io.LimitedReader 类似，但是超过长度后返回 errResponseTooLarge
+type limitReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.N <= 0 {
+		// 探测一下是否还有数据
+		var tmp [1]byte
+		n, err := l.R.Read(tmp[:])
+		if n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.N {
+		p = p[:l.N]
+	}
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+	return n, err
+}
+
+// limitResponseBody 按照 MaxResponseSize 配置限制响应 Body 的大小
+func limitResponseBody(resp *http.Response) (io.Reader, error) {
+	num := getMaxResponseSize()
+	if num <= 0 {
+		return resp.Body, nil
+	}
+	if resp.ContentLength > num {
+		return nil, errResponseTooLarge
+	}
+	return &limitReader{R: resp.Body, N: num}, nil
+}
+
+// writeResponseBody 将上游的响应 Body 写给客户端，若超过 MaxResponseSize 则中断连接
+func writeResponseBody(w http.ResponseWriter, rd io.Reader) (int64, error) {
+	n, err := io.Copy(w, rd)
+	if errors.Is(err, errResponseTooLarge) {
+		// Header 已发送，只能中断连接让客户端感知到响应不完整
+		panic(http.ErrAbortHandler)
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestReplayBody(src io.Reader, memLimit int64, maxSize int64) *replayBody {
+	return &replayBody{src: src, memLimit: memLimit, maxSize: maxSize}
+}
+
+func TestReplayBodyFile(t *testing.T) {
+	data := strings.Repeat("0123456789", 100)
+	rb := newTestReplayBody(strings.NewReader(data), 64, 1<<20)
+	defer rb.Close()
+
+	// 第一次只读取一部分就失败了，之后的重试需要先重放已读取的部分
+	rd, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(rd, make([]byte, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if rb.Buffered() {
+		t.Fatal("should not be buffered yet")
+	}
+
+	for i := range 2 {
+		rd, err = rb.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Fatalf("replay %d: got %d bytes, want %d", i, len(got), len(data))
+		}
+	}
+	if !rb.Buffered() || rb.Size() != int64(len(data)) {
+		t.Fatalf("Buffered()=%v, Size()=%d", rb.Buffered(), rb.Size())
+	}
+	if rb.mem.Len() != 64 || rb.file == nil {
+		t.Fatalf("expect 64 bytes in memory and the rest in a temp file, mem=%d, file=%v", rb.mem.Len(), rb.file)
+	}
+	name := rb.file.Name()
+	rb.Close()
+	if _, err = os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temp file %s is not removed: %v", name, err)
+	}
+}
+
+// TestReplayBodyOverflow 超过 ReplayBufferSize 后仍可以完整读取一次，但是不能再重放
+func TestReplayBodyOverflow(t *testing.T) {
+	data := strings.Repeat("x", 100)
+	rb := newTestReplayBody(strings.NewReader(data), 16, 50)
+	defer rb.Close()
+
+	rd, err := rb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rd)
+	if err != nil || string(got) != data {
+		t.Fatalf("got %d bytes, err=%v", len(got), err)
+	}
+	if _, err = rb.Reader(); !errors.Is(err, errBodyNotReplayable) {
+		t.Fatalf("Reader() err=%v, want errBodyNotReplayable", err)
+	}
+	if err = rb.ReadAll(); !errors.Is(err, errBodyNotReplayable) {
+		t.Fatalf("ReadAll() err=%v, want errBodyNotReplayable", err)
+	}
+	if rb.TooLarge() {
+		t.Fatal("TooLarge() should be false")
+	}
+}
+
+// TestReplayBodyTooLarge 超过 MaxRequestSize 时，转发的请求失败，不会将截断的 Body 发给上游
+func TestReplayBodyTooLarge(t *testing.T) {
+	data := strings.Repeat("x", 100)
+	for _, contentLength := range []int64{int64(len(data)), -1} {
+		t.Run(strconv.FormatInt(contentLength, 10), func(t *testing.T) {
+			var truncated atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				bf, err := io.ReadAll(req.Body)
+				if err == nil && len(bf) != len(data) {
+					truncated.Add(1)
+				}
+			}))
+
+			src := http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(data)), 50)
+			rb := newTestReplayBody(src, 16, 1<<20)
+			defer rb.Close()
+			rd, err := rb.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, ts.URL, rd)
+			req.ContentLength = contentLength
+			resp, err := ts.Client().Do(req)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatal("expect error")
+			}
+			ts.Close()
+			if n := truncated.Load(); n != 0 {
+				t.Fatalf("upstream received %d truncated body", n)
+			}
+			if !rb.TooLarge() {
+				t.Fatal("TooLarge() should be true")
+			}
+		})
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	rd := &limitReader{R: strings.NewReader("0123456789"), N: 10}
+	if got, err := io.ReadAll(rd); err != nil || string(got) != "0123456789" {
+		t.Fatalf("got %q, err=%v", got, err)
+	}
+	rd = &limitReader{R: bytes.NewReader([]byte("0123456789")), N: 5}
+	if _, err := io.ReadAll(rd); !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("err=%v, want errResponseTooLarge", err)
+	}
+}
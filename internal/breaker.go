@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errProxyBroken = errors.New("all proxies are circuit broken")
+
+// breakerConfig 熔断器配置，app.yml 中的 CircuitBreaker
+type breakerConfig struct {
+	Disable     bool    `yaml:"Disable"`     // 是否关闭
+	Failures    int     `yaml:"Failures"`    // 连续失败次数达到此值时熔断，默认 5
+	ErrorRatio  float64 `yaml:"ErrorRatio"`  // 窗口内失败比例达到此值时熔断，默认 0.5
+	MinRequests int     `yaml:"MinRequests"` // 窗口内请求数不少于此值时，才按照失败比例判断，默认 20
+	Window      int     `yaml:"Window"`      // 统计失败比例的时间窗口，单位秒，默认 60
+	CoolDown    int     `yaml:"CoolDown"`    // 熔断后等待多久进入半开状态，单位秒，默认 30
+}
+
+func getBreakerConfig() breakerConfig {
+	cfg := getAppConfig().CircuitBreaker
+	if cfg.Failures <= 0 {
+		cfg.Failures = 5
+	}
+	if cfg.ErrorRatio <= 0 {
+		cfg.ErrorRatio = 0.5
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 60
+	}
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = 30
+	}
+	return cfg
+}
+
+// 熔断器的状态
+const (
+	breakerClosed   = "closed"    // 正常
+	breakerOpen     = "open"      // 熔断，不会被选择
+	breakerHalfOpen = "half-open" // 冷却结束，允许一个探测请求通过
+)
+
+// breakerBuckets 时间窗口分为多少个桶
+const breakerBuckets = 10
+
+type breakerBucket struct {
+	start   int64 // 桶的开始时间，Unix 秒
+	success int64
+	failure int64
+}
+
+// circuitBreaker 根据实际转发请求的结果判断代理是否可用，
+// 连续失败或者窗口内失败比例过高时熔断，不再被选择，冷却之后允许一个探测请求，成功后恢复
+type circuitBreaker struct {
+	mux      sync.Mutex
+	state    string
+	buckets  [breakerBuckets]breakerBucket
+	failures int       // 连续失败的次数
+	openedAt time.Time // 熔断的时间
+	probeAt  time.Time // 半开状态下，探测请求的开始时间
+	opened   int64     // 熔断的次数
+	reason   string    // 最后一次熔断的原因
+}
+
+// windowCount 窗口内的成功和失败次数，需要在锁内调用
+func (cb *circuitBreaker) windowCount(now time.Time, window int) (success int64, failure int64) {
+	since := now.Unix() - int64(window)
+	for _, b := range cb.buckets {
+		if b.start > since {
+			success += b.success
+			failure += b.failure
+		}
+	}
+	return success, failure
+}
+
+// bucket 当前时间对应的桶，需要在锁内调用
+func (cb *circuitBreaker) bucket(now time.Time, window int) *breakerBucket {
+	size := max(int64(window)/breakerBuckets, 1)
+	start := now.Unix() / size * size
+	b := &cb.buckets[(start/size)%breakerBuckets]
+	if b.start != start {
+		*b = breakerBucket{start: start}
+	}
+	return b
+}
+
+// refresh 冷却结束后从熔断进入半开状态，需要在锁内调用
+func (cb *circuitBreaker) refresh(now time.Time, cfg breakerConfig) {
+	if cb.state == breakerOpen && now.Sub(cb.openedAt) >= time.Duration(cfg.CoolDown)*time.Second {
+		cb.state = breakerHalfOpen
+		cb.probeAt = time.Time{}
+	}
+}
+
+// Available 是否可以被选择
+func (cb *circuitBreaker) Available() bool {
+	cfg := getBreakerConfig()
+	if cfg.Disable {
+		return true
+	}
+	now := time.Now()
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.refresh(now, cfg)
+	switch cb.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		// 探测请求未结束时不再选择，探测超过冷却时间仍无结果时，允许再次探测
+		return cb.probeAt.IsZero() || now.Sub(cb.probeAt) >= time.Duration(cfg.CoolDown)*time.Second
+	default:
+		return true
+	}
+}
+
+// begin 开始使用代理，半开状态时作为探测请求
+func (cb *circuitBreaker) begin() {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if cb.state == breakerHalfOpen && cb.probeAt.IsZero() {
+		cb.probeAt = time.Now()
+	}
+}
+
+// record 记录一次使用的结果
+func (cb *circuitBreaker) record(ok bool) {
+	cfg := getBreakerConfig()
+	if cfg.Disable {
+		return
+	}
+	now := time.Now()
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.refresh(now, cfg)
+
+	b := cb.bucket(now, cfg.Window)
+	if ok {
+		b.success++
+		cb.failures = 0
+		if cb.state == breakerHalfOpen {
+			cb.resetLocked()
+		}
+		return
+	}
+	b.failure++
+	cb.failures++
+
+	switch cb.state {
+	case breakerHalfOpen:
+		cb.openLocked(now, "probe failed")
+		return
+	case breakerOpen:
+		return
+	}
+	if cb.failures >= cfg.Failures {
+		cb.openLocked(now, "consecutive failures")
+		return
+	}
+	success, failure := cb.windowCount(now, cfg.Window)
+	if total := success + failure; total >= int64(cfg.MinRequests) && float64(failure)/float64(total) >= cfg.ErrorRatio {
+		cb.openLocked(now, "error ratio")
+	}
+}
+
+func (cb *circuitBreaker) openLocked(now time.Time, reason string) {
+	cb.state = breakerOpen
+	cb.openedAt = now
+	cb.probeAt = time.Time{}
+	cb.opened++
+	cb.reason = reason
+}
+
+func (cb *circuitBreaker) resetLocked() {
+	cb.state = breakerClosed
+	cb.failures = 0
+	cb.buckets = [breakerBuckets]breakerBucket{}
+	cb.probeAt = time.Time{}
+}
+
+// Reset 手动恢复
+func (cb *circuitBreaker) Reset() {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.resetLocked()
+}
+
+// State 当前状态
+func (cb *circuitBreaker) State() string {
+	cfg := getBreakerConfig()
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.refresh(time.Now(), cfg)
+	if cb.state == "" {
+		return breakerClosed
+	}
+	return cb.state
+}
+
+// Info 状态详情，用于页面展示
+func (cb *circuitBreaker) Info() map[string]any {
+	cfg := getBreakerConfig()
+	now := time.Now()
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.refresh(now, cfg)
+	success, failure := cb.windowCount(now, cfg.Window)
+	state := cb.state
+	if state == "" {
+		state = breakerClosed
+	}
+	info := map[string]any{
+		"State":    state,
+		"Failures": cb.failures,
+		"Success":  success,
+		"Failure":  failure,
+		"Opened":   cb.opened,
+		"Reason":   cb.reason,
+		"OpenedAt": "",
+	}
+	if !cb.openedAt.IsZero() {
+		info["OpenedAt"] = cb.openedAt.Format(timeFormatStd)
+	}
+	return info
+}
+
+// proxyBroken 代理是否已熔断，选择代理时会跳过
+func proxyBroken(p *proxyEntry) bool {
+	return !p.State.Breaker.Available()
+}
+
+// recordProxyResult 记录一次通过代理的请求或者连接的结果，用于熔断器和目标域名的信誉，被取消的不计入
+func recordProxyResult(ctx context.Context, p *proxyEntry, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	p.State.Breaker.record(err == nil)
+	reputation.record(ctx, p, err == nil)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xsync"
+)
+
+// setTestAppConfig 测试时使用指定的 app.yml 配置，不读取配置文件
+func setTestAppConfig(t *testing.T, cfg *appConfig) {
+	old := appConfigStore
+	appConfigStore = &xsync.OnceInit[*appConfig]{
+		New: func() *appConfig {
+			return cfg
+		},
+	}
+	t.Cleanup(func() {
+		appConfigStore = old
+	})
+}
+
+func TestCircuitBreakerRecord(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        breakerConfig
+		results    []bool
+		wantState  string
+		wantReason string
+	}{
+		{name: "below failures", cfg: breakerConfig{Failures: 3}, results: []bool{false, false}, wantState: breakerClosed},
+		{name: "consecutive failures", cfg: breakerConfig{Failures: 3}, results: []bool{false, false, false},
+			wantState: breakerOpen, wantReason: "consecutive failures"},
+		{name: "success resets failures", cfg: breakerConfig{Failures: 3}, results: []bool{false, false, true, false, false}, wantState: breakerClosed},
+		{name: "error ratio", cfg: breakerConfig{Failures: 100, MinRequests: 4, ErrorRatio: 0.5}, results: []bool{true, false, true, false},
+			wantState: breakerOpen, wantReason: "error ratio"},
+		{name: "below min requests", cfg: breakerConfig{Failures: 100, MinRequests: 5, ErrorRatio: 0.5}, results: []bool{true, false, true, false},
+			wantState: breakerClosed},
+		{name: "disabled", cfg: breakerConfig{Disable: true, Failures: 1}, results: []bool{false, false}, wantState: breakerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestAppConfig(t, &appConfig{CircuitBreaker: tt.cfg})
+			cb := &circuitBreaker{}
+			for _, ok := range tt.results {
+				cb.record(ok)
+			}
+			if got := cb.State(); got != tt.wantState {
+				t.Fatalf("State()=%q, want %q", got, tt.wantState)
+			}
+			if cb.Available() != (tt.wantState != breakerOpen) {
+				t.Fatalf("Available()=%v in state %q", cb.Available(), tt.wantState)
+			}
+			if got := cb.Info()["Reason"]; got != tt.wantReason {
+				t.Fatalf("Reason=%q, want %q", got, tt.wantReason)
+			}
+		})
+	}
+}
+
+// TestCircuitBreakerHalfOpen 冷却结束后只允许一个探测请求，探测的结果决定恢复还是继续熔断
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	setTestAppConfig(t, &appConfig{CircuitBreaker: breakerConfig{Failures: 1, CoolDown: 30}})
+	for _, probeOK := range []bool{true, false} {
+		cb := &circuitBreaker{}
+		cb.record(false)
+		if cb.Available() {
+			t.Fatal("should be open")
+		}
+
+		cb.mux.Lock()
+		cb.openedAt = time.Now().Add(-31 * time.Second)
+		cb.mux.Unlock()
+		if !cb.Available() || cb.State() != breakerHalfOpen {
+			t.Fatalf("State()=%q, want half-open", cb.State())
+		}
+		cb.begin()
+		if cb.Available() {
+			t.Fatal("only one probe request is allowed")
+		}
+
+		cb.record(probeOK)
+		want := breakerClosed
+		if !probeOK {
+			want = breakerOpen
+		}
+		if got := cb.State(); got != want {
+			t.Fatalf("probe ok=%v: State()=%q, want %q", probeOK, got, want)
+		}
+		if !probeOK && cb.Info()["Reason"] != "probe failed" {
+			t.Fatalf("Reason=%q", cb.Info()["Reason"])
+		}
+		if probeOK && cb.Info()["Opened"] != int64(1) {
+			t.Fatalf("Opened=%v", cb.Info()["Opened"])
+		}
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	const window = 60
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name        string
+		ago         []time.Duration // 每次失败距 now 的时间
+		wantFailure int64
+	}{
+		{name: "in window", ago: []time.Duration{0, 10 * time.Second, 50 * time.Second}, wantFailure: 3},
+		{name: "expired", ago: []time.Duration{61 * time.Second, 2 * time.Minute}, wantFailure: 0},
+		{name: "mixed", ago: []time.Duration{0, 30 * time.Second, 90 * time.Second}, wantFailure: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := &circuitBreaker{}
+			for i := len(tt.ago) - 1; i >= 0; i-- {
+				cb.bucket(now.Add(-tt.ago[i]), window).failure++
+			}
+			success, failure := cb.windowCount(now, window)
+			if success != 0 || failure != tt.wantFailure {
+				t.Fatalf("windowCount()=%d,%d, want 0,%d", success, failure, tt.wantFailure)
+			}
+		})
+	}
+}
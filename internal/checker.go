@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xlog"
+)
+
+// checkScheduleTick 检查到期的代理的间隔
+const checkScheduleTick = 5 * time.Second
+
+// getCheckMaxInterval 检查失败后退避的最大间隔，app.yml 中的 CheckMaxInterval，单位秒，默认 3600，不小于 CheckInterval
+func getCheckMaxInterval() time.Duration {
+	val := xattr.GetDefault[time.Duration]("CheckMaxInterval", 0) * time.Second
+	if val <= 0 {
+		val = time.Hour
+	}
+	return max(val, getCheckInterval())
+}
+
+// nextCheckDelay 下次检查的间隔：正常的使用 CheckInterval，连续失败的按照 2 的指数退避，最大为 CheckMaxInterval，
+// 并加上 ±10% 的随机值，避免同时检查
+func nextCheckDelay(fails int64) time.Duration {
+	delay := getCheckInterval()
+	maxDelay := getCheckMaxInterval()
+	for i := int64(0); i < fails && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	return delay + time.Duration((rand.Float64()-0.5)*0.2*float64(delay))
+}
+
+// recordCheckResult 更新连续失败的次数
+func recordCheckResult(proxy *proxyEntry, ok bool) {
+	if ok {
+		proxy.State.CheckFails.Store(0)
+	} else {
+		proxy.State.CheckFails.Add(1)
+	}
+}
+
+// scheduleNextCheck 根据连续失败的次数设置代理的下次检查时间，quarantined 的按照 CheckMaxInterval 检查
+func scheduleNextCheck(proxy *proxyEntry) {
+	fails := proxy.State.CheckFails.Load()
+	if proxy.LifecycleState() == stateQuarantined {
+		fails = math.MaxInt64
+	}
+	proxy.State.NextCheck.Store(time.Now().Add(nextCheckDelay(fails)))
+}
+
+// checkPriority 检查的优先级，越小越优先：
+// 从快照恢复为 active 的 > 新添加的和手动恢复的 > 最近使用过的 > 其他
+func checkPriority(proxy *proxyEntry) int {
+	if proxy.State.Restored.Load() {
+		return 0
+	}
+	if proxy.State.CheckTimes.Load() == 0 || proxy.LifecycleState() == stateNew {
+		return 1
+	}
+	if proxy.State.InFlight.Load() > 0 || time.Since(proxy.State.LastUsed.Load()) < getCheckInterval() {
+		return 2
+	}
+	return 3
+}
+
+// dueChecks 到期需要检查的代理，按照优先级和到期时间排序，不会修改 items
+func dueChecks(items []*proxyEntry, now time.Time) []*proxyEntry {
+	due := slices.DeleteFunc(slices.Clone(items), func(one *proxyEntry) bool {
+		return one.State.NextCheck.Load().After(now)
+	})
+	slices.SortFunc(due, func(a, b *proxyEntry) int {
+		if pa, pb := checkPriority(a), checkPriority(b); pa != pb {
+			return pa - pb
+		}
+		return a.State.NextCheck.Load().Compare(b.State.NextCheck.Load())
+	})
+	return due
+}
+
+// checkBacklog 已到期还未开始检查的代理数，以及其中到期最久的超过下次检查时间的时长，用于 /status 展示
+func (p *ProxyPool) checkBacklog() (due int, lag time.Duration) {
+	now := time.Now()
+	p.all.Range(func(_ string, one *proxyEntry) bool {
+		next := one.State.NextCheck.Load()
+		if next.After(now) {
+			return true
+		}
+		due++
+		if !next.IsZero() {
+			lag = max(lag, now.Sub(next))
+		}
+		return true
+	})
+	return due, lag
+}
+
+var producerRunning atomic.Bool
+
+// startCheckProducer 每隔 checkScheduleTick 执行一次，将到期的代理加入检查队列，队列已满时剩余的等待下一次
+func (p *ProxyPool) startCheckProducer() {
+	if !producerRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer producerRunning.Store(false)
+
+	now := time.Now()
+	if now.Before(silentDeadline.Load()) {
+		return
+	}
+	items := dueChecks(p.all.All(), now)
+	if len(items) == 0 {
+		return
+	}
+
+	xlog.Info(context.Background(), "CheckProducer starting...", xlog.Int("DueJobs", len(items)))
+	var sent int
+	for _, one := range items {
+		if !p.checker.Submit(one) {
+			break
+		}
+		sent++
+	}
+	xlog.Info(context.Background(), "CheckProducer done",
+		xlog.Int("DueJobs", len(items)),
+		xlog.Int("Sent", sent),
+		xlog.DurationMS("Cost", time.Since(now)),
+	)
+}
+
+// checkAllNow 所有代理立即到期，用于手动开始检查
+func (p *ProxyPool) checkAllNow() {
+	p.all.Range(func(_ string, one *proxyEntry) bool {
+		one.State.NextCheck.Store(time.Time{})
+		return true
+	})
+	p.startCheckProducer()
+}
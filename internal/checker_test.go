@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDueChecks(t *testing.T) {
+	pl := newProxyList([]*proxyBase{
+		{Proxy: "http://127.0.0.1:1"},
+		{Proxy: "http://127.0.0.1:2"},
+		{Proxy: "http://127.0.0.1:3"},
+		{Proxy: "http://127.0.0.1:4"},
+	})
+	now := time.Now()
+	all := pl.All()
+	for i, one := range all {
+		one.State.CheckTimes.Store(1)
+		one.State.Lifecycle.Store(stateActive)
+		// 1、3 还未到期
+		if i%2 == 0 {
+			one.State.NextCheck.Store(now.Add(time.Minute))
+		} else {
+			one.State.NextCheck.Store(now.Add(-time.Duration(i) * time.Second))
+		}
+	}
+	before := slices.Clone(all)
+
+	due := dueChecks(pl.All(), now)
+	// 到期越久的越优先
+	want := []*proxyEntry{before[3], before[1]}
+	if !slices.Equal(due, want) {
+		t.Fatalf("dueChecks()=%v, want %v", due, want)
+	}
+	if got := pl.All(); !slices.Equal(got, before) {
+		t.Fatalf("dueChecks() modified the list: %v", got)
+	}
+	pl.Range(func(_ string, one *proxyEntry) bool {
+		if one == nil {
+			t.Fatal("nil proxy in list")
+		}
+		return true
+	})
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/safely"
+	"github.com/xanygo/anygo/xattr"
+)
+
+// checkerConfig 检查的并发数、队列长度和超时，初始值来自 app.yml，可以通过 /checker 在运行时修改
+type checkerConfig struct {
+	Workers   int           // 并发检查的数量，app.yml 中的 CheckWorkers，默认 8
+	QueueSize int           // 等待检查的队列长度，app.yml 中的 CheckQueueSize，默认 1024
+	Timeout   time.Duration // 检查一个代理的超时，app.yml 中的 CheckTimeout，单位秒，默认使用 ProxyTimeout
+}
+
+func loadCheckerConfig() checkerConfig {
+	cfg := checkerConfig{
+		Workers:   xattr.GetDefault[int]("CheckWorkers", 8),
+		QueueSize: xattr.GetDefault[int]("CheckQueueSize", 1024),
+		Timeout:   xattr.GetDefault[time.Duration]("CheckTimeout", 0) * time.Second,
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = getProxyTimeout()
+	}
+	return cfg
+}
+
+// 检查的并发数和队列长度的上限
+const (
+	checkerMaxWorkers   = 1024
+	checkerMaxQueueSize = 1000000
+)
+
+func (c checkerConfig) validate() error {
+	if c.Workers <= 0 || c.Workers > checkerMaxWorkers {
+		return errors.New("invalid Workers, should be in [1, 1024]")
+	}
+	if c.QueueSize <= 0 || c.QueueSize > checkerMaxQueueSize {
+		return errors.New("invalid QueueSize, should be in [1, 1000000]")
+	}
+	if c.Timeout < time.Second {
+		return errors.New("invalid Timeout, should be at least 1 second")
+	}
+	return nil
+}
+
+// checkJob 检查队列中的一个代理
+type checkJob struct {
+	proxy    *proxyEntry
+	priority int // 越小越优先，见 checkPriority
+	seq      int64
+	index    int
+}
+
+// checkJobHeap 按照优先级和加入的顺序排序
+type checkJobHeap []*checkJob
+
+func (h checkJobHeap) Len() int { return len(h) }
+
+func (h checkJobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h checkJobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *checkJobHeap) Push(x any) {
+	job := x.(*checkJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *checkJobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return job
+}
+
+// checkRunner 检查队列和执行检查的 worker，同一个代理在队列中只会有一个
+type checkRunner struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	cfg     checkerConfig
+	jobs    checkJobHeap
+	queued  map[string]*checkJob
+	seq     int64
+	workers map[int]bool // 运行中的 worker 的编号
+	done    trafficWindow
+
+	inFlight atomic.Int64
+	check    func(proxy *proxyEntry) bool
+}
+
+func newCheckRunner(cfg checkerConfig, check func(proxy *proxyEntry) bool) *checkRunner {
+	c := &checkRunner{
+		queued:  make(map[string]*checkJob),
+		workers: make(map[int]bool),
+		// 最近 1 分钟完成的检查数，每 10 秒一个时间片，Up 为通过的数量，Down 为未通过的
+		done:  newTrafficWindow(10*time.Second, 6),
+		check: check,
+	}
+	c.cond = sync.NewCond(&c.mux)
+	if err := c.SetConfig(cfg); err != nil {
+		log.Fatalln("invalid checker config:", err)
+	}
+	return c
+}
+
+// SetConfig 修改配置，worker 数减少时，多余的 worker 会在当前的检查完成后退出；
+// 队列长度减少时，已在队列中的不受影响
+func (c *checkRunner) SetConfig(cfg checkerConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.cfg = cfg
+	for id := range cfg.Workers {
+		if !c.workers[id] {
+			c.workers[id] = true
+			go safely.Run(func() {
+				c.worker(id)
+			})
+		}
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *checkRunner) Config() checkerConfig {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.cfg
+}
+
+func (c *checkRunner) Timeout() time.Duration {
+	return c.Config().Timeout
+}
+
+// Submit 将代理加入检查队列，不会阻塞。已在队列中时只会提升优先级，队列已满时返回 false。
+// 加入后会推迟代理的下次检查时间，避免在检查完成前被调度重复加入
+func (c *checkRunner) Submit(proxy *proxyEntry) bool {
+	priority := checkPriority(proxy)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if job, ok := c.queued[proxy.Base.Proxy]; ok {
+		if priority < job.priority {
+			job.priority = priority
+			heap.Fix(&c.jobs, job.index)
+		}
+		return true
+	}
+	if len(c.jobs) >= c.cfg.QueueSize {
+		return false
+	}
+	c.seq++
+	job := &checkJob{proxy: proxy, priority: priority, seq: c.seq}
+	heap.Push(&c.jobs, job)
+	c.queued[proxy.Base.Proxy] = job
+	proxy.State.NextCheck.Store(time.Now().Add(getCheckInterval()))
+	c.cond.Signal()
+	return true
+}
+
+// Remove 从队列中删除代理，如代理已被删除
+func (c *checkRunner) Remove(proxy *proxyEntry) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if job, ok := c.queued[proxy.Base.Proxy]; ok {
+		heap.Remove(&c.jobs, job.index)
+		delete(c.queued, proxy.Base.Proxy)
+	}
+}
+
+// next 取出优先级最高的一个，没有时等待，worker 需要退出时返回 false
+func (c *checkRunner) next(id int) (*proxyEntry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for {
+		if id >= c.cfg.Workers {
+			delete(c.workers, id)
+			return nil, false
+		}
+		if len(c.jobs) > 0 {
+			job := heap.Pop(&c.jobs).(*checkJob)
+			delete(c.queued, job.proxy.Base.Proxy)
+			return job.proxy, true
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *checkRunner) worker(id int) {
+	for {
+		one, ok := c.next(id)
+		if !ok {
+			return
+		}
+		c.inFlight.Add(1)
+		ok = false
+		safely.Run(func() {
+			ok = c.check(one)
+		})
+		c.inFlight.Add(-1)
+
+		var passed, failed int64 = 0, 1
+		if ok {
+			passed, failed = 1, 0
+		}
+		c.mux.Lock()
+		c.done.add(time.Now().Unix(), passed, failed)
+		c.mux.Unlock()
+	}
+}
+
+// Len 队列中等待检查的数量
+func (c *checkRunner) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.jobs)
+}
+
+// Status 用于 /status 和 /checker 展示
+func (c *checkRunner) Status() map[string]any {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	passed, failed := c.done.sum(time.Now().Unix())
+	return map[string]any{
+		"Workers":     c.cfg.Workers,
+		"QueueSize":   c.cfg.QueueSize,
+		"Timeout":     c.cfg.Timeout.String(),
+		"QueueLength": len(c.jobs),
+		"InFlight":    c.inFlight.Load(),
+		"Throughput": map[string]any{ // 最近 1 分钟
+			"Total":  passed + failed,
+			"Passed": passed,
+			"Failed": failed,
+		},
+	}
+}
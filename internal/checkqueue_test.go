@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCheckRunner 不启动 worker，通过 next 取出任务
+func newTestCheckRunner(queueSize int) *checkRunner {
+	c := &checkRunner{
+		cfg:     checkerConfig{Workers: 1, QueueSize: queueSize, Timeout: time.Second},
+		queued:  make(map[string]*checkJob),
+		workers: make(map[int]bool),
+	}
+	c.cond = sync.NewCond(&c.mux)
+	return c
+}
+
+// newCheckedProxy 检查过的 active 代理，优先级为 3
+func newCheckedProxy(id int) *proxyEntry {
+	p := newProxy("http://127.0.0.1:" + strconv.Itoa(10000+id))
+	p.State.CheckTimes.Store(1)
+	p.State.Lifecycle.Store(stateActive)
+	return p
+}
+
+func drainCheckRunner(c *checkRunner) []*proxyEntry {
+	var result []*proxyEntry
+	for c.Len() > 0 {
+		one, ok := c.next(0)
+		if !ok {
+			break
+		}
+		result = append(result, one)
+	}
+	return result
+}
+
+func TestCheckRunnerDedup(t *testing.T) {
+	c := newTestCheckRunner(10)
+	a := newCheckedProxy(1)
+	b := newCheckedProxy(2)
+	for _, p := range []*proxyEntry{a, a, b, a} {
+		if !c.Submit(p) {
+			t.Fatal("Submit failed")
+		}
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Len()=%d, want 2", c.Len())
+	}
+	if !a.State.NextCheck.Load().After(time.Now()) {
+		t.Fatal("NextCheck should be delayed after Submit")
+	}
+	got := drainCheckRunner(c)
+	if len(got) != 2 || got[0] != a || got[1] != b {
+		t.Fatalf("got %v", got)
+	}
+
+	// 取出后可以再次加入
+	if !c.Submit(a) || c.Len() != 1 {
+		t.Fatalf("Len()=%d, want 1", c.Len())
+	}
+	c.Remove(a)
+	if c.Len() != 0 {
+		t.Fatalf("Len()=%d after Remove, want 0", c.Len())
+	}
+}
+
+func TestCheckRunnerPriority(t *testing.T) {
+	c := newTestCheckRunner(10)
+	other1 := newCheckedProxy(1)
+	other2 := newCheckedProxy(2)
+
+	recent := newCheckedProxy(3)
+	recent.State.LastUsed.Store(time.Now())
+
+	fresh := newCheckedProxy(4)
+	fresh.State.CheckTimes.Store(0)
+	fresh.State.Lifecycle.Store("")
+
+	restored := newCheckedProxy(5)
+	restored.State.Restored.Store(true)
+
+	for _, p := range []*proxyEntry{other1, recent, other2, fresh, restored} {
+		c.Submit(p)
+	}
+	// 已在队列中的，再次加入时只会提升优先级
+	bumped := newCheckedProxy(6)
+	c.Submit(bumped)
+	bumped.State.Restored.Store(true)
+	c.Submit(bumped)
+	restored.State.Restored.Store(false)
+	c.Submit(restored)
+
+	want := []*proxyEntry{restored, bumped, fresh, recent, other1, other2}
+	got := drainCheckRunner(c)
+	if len(got) != len(want) {
+		t.Fatalf("got %d jobs, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("job %d is %s, want %s", i, got[i].Base.Proxy, want[i].Base.Proxy)
+		}
+	}
+}
+
+func TestCheckRunnerQueueFull(t *testing.T) {
+	c := newTestCheckRunner(2)
+	a, b, d := newCheckedProxy(1), newCheckedProxy(2), newCheckedProxy(3)
+	if !c.Submit(a) || !c.Submit(b) {
+		t.Fatal("Submit failed")
+	}
+	if c.Submit(d) {
+		t.Fatal("Submit should fail when the queue is full")
+	}
+	// 已在队列中的仍然返回 true
+	if !c.Submit(a) {
+		t.Fatal("Submit of a queued proxy should succeed")
+	}
+}
+
+func TestCheckerConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg checkerConfig
+		ok  bool
+	}{
+		{cfg: checkerConfig{Workers: 8, QueueSize: 1024, Timeout: 5 * time.Second}, ok: true},
+		{cfg: checkerConfig{Workers: 0, QueueSize: 1024, Timeout: 5 * time.Second}},
+		{cfg: checkerConfig{Workers: 1025, QueueSize: 1024, Timeout: 5 * time.Second}},
+		{cfg: checkerConfig{Workers: 8, QueueSize: 0, Timeout: 5 * time.Second}},
+		{cfg: checkerConfig{Workers: 8, QueueSize: 1024, Timeout: time.Millisecond}},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v)=%v", tt.cfg, err)
+		}
+	}
+}
@@ -35,12 +35,16 @@ func httpGetByProxyEntry(ctx context.Context, urlStr string, proxy *proxyEntry)
 }
 
 func httpGetByProxyURL(ctx context.Context, urlStr string, proxy *url.URL) (resp *http.Response, err error) {
+	return httpRequestByProxyURL(ctx, http.MethodGet, urlStr, proxy)
+}
+
+func httpRequestByProxyURL(ctx context.Context, method string, urlStr string, proxy *url.URL) (resp *http.Response, err error) {
 	c, err := httpClientProxied(proxy)
 	if err != nil {
 		return nil, err
 	}
 	defer c.CloseIdleConnections()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, nil)
 	if err != nil {
 		return nil, err
 	}
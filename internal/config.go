@@ -9,9 +9,47 @@ import (
 	"time"
 
 	"github.com/xanygo/anygo/ds/xslice"
+	"github.com/xanygo/anygo/ds/xsync"
 	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xcfg"
 )
 
+// appConfigFile 应用主配置文件的路径，即 -conf 参数
+var appConfigFile string
+
+// appConfig 主配置文件中结构化的配置项，简单的配置项通过 xattr 读取
+type appConfig struct {
+	Listeners []*listenerConfig  `yaml:"Listeners"`
+	Rules     []*routeRuleConfig `yaml:"Rules"`
+
+	GeoIPFiles []string `yaml:"GeoIPFiles"`
+
+	Limits limitsConfig `yaml:"Limits"`
+
+	CircuitBreaker breakerConfig `yaml:"CircuitBreaker"`
+
+	Reputation reputationConfig `yaml:"Reputation"`
+	BanRules   []*banRuleConfig `yaml:"BanRules"`
+
+	Probes []*probeConfig `yaml:"Probes"`
+
+	Lifecycle lifecycleConfig `yaml:"Lifecycle"`
+}
+
+var appConfigStore = &xsync.OnceInit[*appConfig]{
+	New: func() *appConfig {
+		cfg := &appConfig{}
+		if err := xcfg.Parse(appConfigFile, cfg); err != nil {
+			log.Fatalln("parse", appConfigFile, "failed:", err)
+		}
+		return cfg
+	},
+}
+
+func getAppConfig() *appConfig {
+	return appConfigStore.Load()
+}
+
 func getProbeURL() string {
 	str, _ := xattr.GetAs[string]("ProbeURL")
 	if str != "" && strings.Contains(str, "{rand}") {
@@ -59,6 +97,25 @@ func getProxyRetryMax() int {
 	return 10
 }
 
+// 对冲请求最大的并发数
+// 客户端通过 HTTP Header [X-Man-Hedge] 指定
+func getHedgeMax() int {
+	num := xattr.GetDefault[int]("HedgeMax", 0)
+	if num > 0 {
+		return num
+	}
+	return 5
+}
+
+// 对冲请求时，每个请求的启动间隔
+func getHedgeDelay() time.Duration {
+	num := xattr.GetDefault[int]("HedgeDelay", 0)
+	if num > 0 {
+		return time.Duration(num) * time.Millisecond
+	}
+	return 100 * time.Millisecond
+}
+
 func parserProxiesFromTxt(txt string) *ProxyList {
 	defaultValues := make(map[string]string)
 	defaultValues["proxy"] = "required"
@@ -128,6 +185,30 @@ func parseProxyLine(info map[string]string) *proxyEntry {
 	return p
 }
 
+// 响应 Body 的最大长度，0 为不限制
 func getMaxResponseSize() int64 {
 	return xattr.GetDefault[int64]("MaxResponseSize", 0)
 }
+
+// 请求 Body 的最大长度，0 为不限制
+func getMaxRequestSize() int64 {
+	return xattr.GetDefault[int64]("MaxRequestSize", 0)
+}
+
+// 用于重试时重放请求 Body 的缓存的最大长度，超过后该请求不再重试
+func getReplayBufferSize() int64 {
+	num := xattr.GetDefault[int64]("ReplayBufferSize", 0)
+	if num > 0 {
+		return num
+	}
+	return 4 << 20
+}
+
+// 重放缓存中，保存在内存中的最大长度，超过的部分写入临时文件
+func getReplayMemorySize() int64 {
+	num := xattr.GetDefault[int64]("ReplayMemorySize", 0)
+	if num > 0 {
+		return num
+	}
+	return 1 << 20
+}
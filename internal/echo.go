@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xlog"
+)
+
+// echoResponse /echo 返回的内容：请求方的 IP 和收到的所有 Header
+type echoResponse struct {
+	IP      string      `json:"IP"`
+	Method  string      `json:"Method"`
+	Host    string      `json:"Host"`
+	URI     string      `json:"URI"`
+	Proto   string      `json:"Proto"`
+	Headers http.Header `json:"Headers"`
+}
+
+// handleEcho 返回请求方的 IP 和 Header，用于检查代理的出口 IP 和匿名级别，不需要登录
+func (aw *adminWeb) handleEcho(w http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.Unmap().String()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, echoResponse{
+		IP:      host,
+		Method:  req.Method,
+		Host:    req.Host,
+		URI:     req.RequestURI,
+		Proto:   req.Proto,
+		Headers: req.Header,
+	})
+}
+
+// getEchoURL 检查代理匿名级别时使用的 /echo 地址，需要是代理可以访问的公网地址，
+// 如 http://example.com:8128/echo ，app.yml 中的 EchoURL，为空时不检查
+func getEchoURL() string {
+	return strings.TrimSpace(xattr.GetDefault[string]("EchoURL", ""))
+}
+
+// 代理的匿名级别，会作为自动标签
+const (
+	anonymityTransparent = "transparent" // 泄露了真实 IP
+	anonymityAnonymous   = "anonymous"   // 没有泄露真实 IP，但是可以看出使用了代理
+	anonymityElite       = "elite"       // 看不出使用了代理
+)
+
+// proxyLeakHeaders 会暴露使用了代理的 Header
+var proxyLeakHeaders = []string{
+	"Via",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	"Forwarded",
+	"Forwarded-For",
+	"Client-Ip",
+	"X-Client-Ip",
+	"X-Proxy-Id",
+	"Proxy-Connection",
+}
+
+// proxyIPHeaders 可能含有请求方真实 IP 的 Header
+var proxyIPHeaders = []string{
+	"X-Forwarded-For",
+	"X-Real-Ip",
+	"Forwarded",
+	"Forwarded-For",
+	"Client-Ip",
+	"X-Client-Ip",
+}
+
+// classifyAnonymity 根据通过代理访问 /echo 的结果判断匿名级别，realIP 为不使用代理访问 /echo 时的 IP。
+// realIP 未知时，Header 中含有出口 IP 之外的 IP 无法判断是否为真实 IP（也可能是上游代理的），返回空
+func classifyAnonymity(echo *echoResponse, realIP string) string {
+	var unknown bool
+	for _, name := range proxyIPHeaders {
+		for _, val := range echo.Headers.Values(name) {
+			for _, ip := range parseHeaderIPs(val) {
+				if realIP != "" && ip == realIP {
+					return anonymityTransparent
+				}
+				if realIP == "" && ip != echo.IP {
+					unknown = true
+				}
+			}
+		}
+	}
+	if unknown {
+		return ""
+	}
+	for _, name := range proxyLeakHeaders {
+		if len(echo.Headers.Values(name)) > 0 {
+			return anonymityAnonymous
+		}
+	}
+	return anonymityElite
+}
+
+// parseHeaderIPs 解析 Header 中的 IP，如 X-Forwarded-For: 1.2.3.4, 5.6.7.8 、Forwarded: for="[::1]:80";proto=http
+func parseHeaderIPs(val string) []string {
+	var result []string
+	for _, field := range strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	}) {
+		if key, v, ok := strings.Cut(field, "="); ok {
+			if !strings.EqualFold(key, "for") {
+				continue
+			}
+			field = v
+		}
+		field = strings.Trim(field, `"`)
+		if host, _, err := net.SplitHostPort(field); err == nil {
+			field = host
+		}
+		field = strings.Trim(field, "[]")
+		if addr, err := netip.ParseAddr(field); err == nil {
+			result = append(result, addr.Unmap().String())
+		}
+	}
+	return result
+}
+
+// fetchEcho 通过代理访问 /echo
+func fetchEcho(ctx context.Context, urlStr string, proxy *proxyEntry) (*echoResponse, error) {
+	resp, err := httpGetByProxyEntry(ctx, urlStr, proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	echo := &echoResponse{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, probeMaxBodySize)).Decode(echo); err != nil {
+		return nil, fmt.Errorf("invalid echo response: %w", err)
+	}
+	return echo, nil
+}
+
+// echoRealIP 不使用代理访问 /echo 时的 IP，成功的缓存 10 分钟，失败的缓存 1 分钟
+var echoRealIP = struct {
+	mux      sync.Mutex
+	ip       string
+	expire   time.Time
+	fetching bool
+}{}
+
+// getEchoRealIP 返回缓存的 IP，过期后只由一个调用方重新获取，获取期间其他调用方使用之前的结果
+func getEchoRealIP(ctx context.Context, urlStr string) string {
+	echoRealIP.mux.Lock()
+	if echoRealIP.fetching || time.Now().Before(echoRealIP.expire) {
+		ip := echoRealIP.ip
+		echoRealIP.mux.Unlock()
+		return ip
+	}
+	echoRealIP.fetching = true
+	echoRealIP.mux.Unlock()
+
+	var ip string
+	ttl := 10 * time.Minute
+	echo, err := fetchEcho(ctx, urlStr, directEntry)
+	if err != nil {
+		xlog.Warn(ctx, "fetch echo directly failed", xlog.ErrorAttr("Error", err))
+		ttl = time.Minute
+	} else {
+		ip = echo.IP
+	}
+
+	echoRealIP.mux.Lock()
+	defer echoRealIP.mux.Unlock()
+	echoRealIP.ip = ip
+	echoRealIP.expire = time.Now().Add(ttl)
+	echoRealIP.fetching = false
+	return ip
+}
+
+// checkAnonymity 配置了 EchoURL 时，通过代理访问 /echo，更新代理的出口 IP 和匿名级别，
+// 失败时不影响代理是否可用
+func checkAnonymity(ctx context.Context, proxy *proxyEntry) {
+	urlStr := getEchoURL()
+	if urlStr == "" {
+		return
+	}
+	// 探测可能已经用掉了大部分的超时时间
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pool.checker.Timeout())
+	defer cancel()
+	echo, err := fetchEcho(ctx, urlStr, proxy)
+	if err != nil {
+		xlog.Warn(ctx, "check anonymity failed", xlog.ErrorAttr("Error", err))
+		return
+	}
+	if addr, err := netip.ParseAddr(echo.IP); err == nil {
+		setExitIP(proxy, addr.Unmap().String())
+	}
+	level := classifyAnonymity(echo, getEchoRealIP(ctx, urlStr))
+	if level == "" {
+		// 不知道本机的真实 IP，无法判断，保持不变
+		xlog.AddAttr(ctx, xlog.String("Anonymity", "unknown"))
+		return
+	}
+	if proxy.State.Anonymity.Load() != level {
+		proxy.State.Anonymity.Store(level)
+		updateAutoTags(proxy)
+	}
+	xlog.AddAttr(ctx, xlog.String("Anonymity", level))
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseHeaderIPs(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []string
+	}{
+		{val: "1.2.3.4, 5.6.7.8", want: []string{"1.2.3.4", "5.6.7.8"}},
+		{val: `for="[::1]:80";proto=http;by=9.9.9.9`, want: []string{"::1"}},
+		{val: "for=1.2.3.4:8080, for=::ffff:5.6.7.8", want: []string{"1.2.3.4", "5.6.7.8"}},
+		{val: "unknown, _hidden"},
+	}
+	for _, tt := range tests {
+		if got := parseHeaderIPs(tt.val); !slices.Equal(got, tt.want) {
+			t.Errorf("parseHeaderIPs(%q)=%q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyAnonymity(t *testing.T) {
+	const exitIP = "5.6.7.8"
+	tests := []struct {
+		name    string
+		headers http.Header
+		realIP  string
+		want    string
+	}{
+		{name: "leak real ip", headers: http.Header{"X-Forwarded-For": {"1.1.1.1, " + exitIP}}, realIP: "1.1.1.1", want: anonymityTransparent},
+		{name: "chained proxy", headers: http.Header{"X-Forwarded-For": {"2.2.2.2"}}, realIP: "1.1.1.1", want: anonymityAnonymous},
+		{name: "via only", headers: http.Header{"Via": {"1.1 squid"}}, realIP: "1.1.1.1", want: anonymityAnonymous},
+		{name: "no header", headers: http.Header{}, realIP: "1.1.1.1", want: anonymityElite},
+
+		// 不知道真实 IP
+		{name: "unknown real ip", headers: http.Header{"X-Forwarded-For": {"2.2.2.2"}}, want: ""},
+		{name: "unknown real ip, exit ip only", headers: http.Header{"X-Real-Ip": {exitIP}}, want: anonymityAnonymous},
+		{name: "unknown real ip, no header", headers: http.Header{}, want: anonymityElite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := &echoResponse{IP: exitIP, Headers: tt.headers}
+			if got := classifyAnonymity(echo, tt.realIP); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestGetEchoRealIPFetching 正在获取时，其他调用方直接使用之前的结果，不会等待
+func TestGetEchoRealIPFetching(t *testing.T) {
+	echoRealIP.mux.Lock()
+	echoRealIP.ip = "1.1.1.1"
+	echoRealIP.expire = time.Now().Add(-time.Second)
+	echoRealIP.fetching = true
+	echoRealIP.mux.Unlock()
+	defer func() {
+		echoRealIP.mux.Lock()
+		echoRealIP.ip, echoRealIP.expire, echoRealIP.fetching = "", time.Time{}, false
+		echoRealIP.mux.Unlock()
+	}()
+
+	if got := getEchoRealIP(context.Background(), "http://127.0.0.1:1/echo"); got != "1.1.1.1" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xlog"
+)
+
+// 事件的类型
+const (
+	eventExitIPChanged = "exit-ip-changed" // 代理的出口 IP 变化了
+)
+
+// proxyEvent 代理相关的事件，保存最近的一部分，可在 /events 查看，
+// 配置了 EventWebhook 时，会 POST JSON 到该地址
+type proxyEvent struct {
+	Time  time.Time `json:"Time"`
+	Type  string    `json:"Type"`
+	Proxy string    `json:"Proxy"`
+	Old   string    `json:"Old,omitempty"`
+	New   string    `json:"New,omitempty"`
+	Msg   string    `json:"Msg,omitempty"`
+}
+
+// eventLogSize 最多保存的事件数
+const eventLogSize = 1000
+
+type eventLog struct {
+	mux   sync.Mutex
+	items []proxyEvent // 循环使用
+	next  int
+
+	webhook chan proxyEvent
+}
+
+var events = &eventLog{
+	webhook: make(chan proxyEvent, 100),
+}
+
+// Add 记录一个事件
+func (el *eventLog) Add(e proxyEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	xlog.Info(context.Background(), "proxy event",
+		xlog.String("Type", e.Type),
+		xlog.String("Proxy", e.Proxy),
+		xlog.String("Old", e.Old),
+		xlog.String("New", e.New),
+		xlog.String("Msg", e.Msg),
+	)
+	el.mux.Lock()
+	if len(el.items) < eventLogSize {
+		el.items = append(el.items, e)
+	} else {
+		el.items[el.next] = e
+	}
+	el.next = (el.next + 1) % eventLogSize
+	el.mux.Unlock()
+
+	if getEventWebhook() == "" {
+		return
+	}
+	select {
+	case el.webhook <- e:
+	default:
+		xlog.Warn(context.Background(), "event webhook queue is full, dropped", xlog.String("Type", e.Type))
+	}
+}
+
+// List 最近的事件，按照时间倒序，typ 不为空时只返回该类型的，limit<=0 时返回全部
+func (el *eventLog) List(typ string, limit int) []proxyEvent {
+	el.mux.Lock()
+	n := len(el.items)
+	result := make([]proxyEvent, 0, n)
+	for i := range n {
+		// 从最新的开始
+		e := el.items[((el.next-1-i)%n+n)%n]
+		if typ == "" || e.Type == typ {
+			result = append(result, e)
+		}
+	}
+	el.mux.Unlock()
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// getEventWebhook 接收事件的地址，app.yml 中的 EventWebhook
+func getEventWebhook() string {
+	return xattr.GetDefault[string]("EventWebhook", "")
+}
+
+// sendWebhook 依次发送事件到 EventWebhook，在 Setup 中启动
+func (el *eventLog) sendWebhook() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for e := range el.webhook {
+		urlStr := getEventWebhook()
+		if urlStr == "" {
+			continue
+		}
+		bf, _ := json.Marshal(e)
+		resp, err := client.Post(urlStr, "application/json", bytes.NewReader(bf))
+		if err != nil {
+			xlog.Warn(context.Background(), "send event webhook failed", xlog.ErrorAttr("Error", err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			xlog.Warn(context.Background(), "send event webhook failed", xlog.Int("StatusCode", resp.StatusCode))
+		}
+	}
+}
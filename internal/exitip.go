@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/xanygo/anygo/xattr"
+)
+
+// exitIPIndex 出口 IP 到代理的索引，用于发现共用同一个出口 IP 的代理
+type exitIPIndex struct {
+	mux   sync.Mutex
+	items map[string]map[string]struct{} // exitIP -> 代理地址
+}
+
+var exitIPs = &exitIPIndex{
+	items: make(map[string]map[string]struct{}),
+}
+
+func (ei *exitIPIndex) set(proxy string, old string, ip string) {
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	if keys, ok := ei.items[old]; ok {
+		delete(keys, proxy)
+		if len(keys) == 0 {
+			delete(ei.items, old)
+		}
+	}
+	if ip == "" {
+		return
+	}
+	keys, ok := ei.items[ip]
+	if !ok {
+		keys = make(map[string]struct{})
+		ei.items[ip] = keys
+	}
+	keys[proxy] = struct{}{}
+}
+
+// Proxies 使用该出口 IP 的代理，已删除的代理会被清理掉
+func (ei *exitIPIndex) Proxies(ip string) []string {
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	keys := ei.items[ip]
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		if one := pool.all.Get(key); one == nil || one.State.ExitIP.Load() != ip {
+			delete(keys, key)
+			continue
+		}
+		result = append(result, key)
+	}
+	if len(keys) == 0 {
+		delete(ei.items, ip)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// Shared 被多个代理共用的出口 IP 及其代理数
+func (ei *exitIPIndex) Shared() map[string]int {
+	ei.mux.Lock()
+	ips := make([]string, 0, len(ei.items))
+	for ip, keys := range ei.items {
+		if len(keys) > 1 {
+			ips = append(ips, ip)
+		}
+	}
+	ei.mux.Unlock()
+
+	result := make(map[string]int, len(ips))
+	for _, ip := range ips {
+		if n := len(ei.Proxies(ip)); n > 1 {
+			result[ip] = n
+		}
+	}
+	return result
+}
+
+// setExitIP 更新代理的出口 IP，变化时同时更新国家和 ASN 标签，并记录 exit-ip-changed 事件
+func setExitIP(proxy *proxyEntry, ip string) {
+	old := proxy.State.ExitIP.Load()
+	if old == ip {
+		return
+	}
+	proxy.State.ExitIP.Store(ip)
+	exitIPs.set(proxy.Base.Proxy, old, ip)
+	updateProxyGeo(proxy)
+	if old != "" {
+		events.Add(proxyEvent{
+			Type:  eventExitIPChanged,
+			Proxy: proxy.Base.Proxy,
+			Old:   old,
+			New:   ip,
+		})
+	}
+}
+
+// SharedExitIP 和当前代理使用同一个出口 IP 的其他代理
+func (p *proxyEntry) SharedExitIP() []string {
+	ip := p.State.ExitIP.Load()
+	if ip == "" {
+		return nil
+	}
+	return slices.DeleteFunc(exitIPs.Proxies(ip), func(key string) bool {
+		return key == p.Base.Proxy
+	})
+}
+
+// getCollapseExitIP 筛选代理时，出口 IP 相同的是否只保留一个，app.yml 中的 CollapseExitIP
+func getCollapseExitIP() bool {
+	return xattr.GetDefault[bool]("CollapseExitIP", false)
+}
+
+// collapseByExitIP 出口 IP 相同的代理随机保留一个，还不知道出口 IP 的都保留
+func collapseByExitIP(list []*proxyEntry) []*proxyEntry {
+	index := make(map[string]int, len(list))
+	seen := make(map[string]int, len(list))
+	result := make([]*proxyEntry, 0, len(list))
+	for _, p := range list {
+		ip := p.State.ExitIP.Load()
+		if ip == "" {
+			result = append(result, p)
+			continue
+		}
+		seen[ip]++
+		i, ok := index[ip]
+		if !ok {
+			index[ip] = len(result)
+			result = append(result, p)
+			continue
+		}
+		// 蓄水池抽样，使每个代理被保留的概率相同
+		if rand.IntN(seen[ip]) == 0 {
+			result[i] = p
+		}
+	}
+	if len(result) == len(list) {
+		return list
+	}
+	return result
+}
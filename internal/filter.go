@@ -0,0 +1,559 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xslice"
+)
+
+// 筛选代理的条件支持两种格式：
+//
+//	标签：tag1 & tag2,tag3,[ANY]，见 ProxyList.Filter
+//	表达式：tag:us && !tag:flaky && latency<500ms && scheme in (socks5,ss) && country!=CN && successRate>0.9
+//
+// 包含 : = ! < > ( ) 引号 && || 之一时，按照表达式解析。
+// 也可以分层，见 filterTier
+
+// proxyFilter 编译后的筛选条件，返回满足条件的，保持原有的顺序
+type proxyFilter func(all []*proxyEntry) []*proxyEntry
+
+// filterError 筛选条件有语法错误
+type filterError struct {
+	Filter string
+	Pos    int // 出错的位置，从 1 开始，0 为未知
+	Msg    string
+}
+
+func (e *filterError) Error() string {
+	if e.Pos > 0 {
+		return fmt.Sprintf("invalid filter %q at %d: %s", e.Filter, e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("invalid filter %q: %s", e.Filter, e.Msg)
+}
+
+func isFilterError(err error) bool {
+	var fe *filterError
+	return errors.As(err, &fe)
+}
+
+// writeFilterError 返回 400
+func writeFilterError(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(err.Error()))
+}
+
+// filterCacheSize 最多缓存多少个编译后的筛选条件，超过后清空重新缓存
+const filterCacheSize = 1024
+
+// compiledFilter 编译后的筛选条件
+type compiledFilter struct {
+	fn    proxyFilter
+	tiers filterTiers // 分层的筛选条件，不分层时为 nil
+	err   error
+}
+
+var filterCache = struct {
+	mux   sync.RWMutex
+	items map[string]*compiledFilter
+}{
+	items: make(map[string]*compiledFilter),
+}
+
+// loadFilter 编译筛选条件，结果（包括错误）会被缓存
+func loadFilter(filter string) *compiledFilter {
+	filterCache.mux.RLock()
+	c, ok := filterCache.items[filter]
+	filterCache.mux.RUnlock()
+	if ok {
+		return c
+	}
+
+	c = compileFilter(filter)
+
+	filterCache.mux.Lock()
+	if len(filterCache.items) >= filterCacheSize {
+		clear(filterCache.items)
+	}
+	filterCache.items[filter] = c
+	filterCache.mux.Unlock()
+	return c
+}
+
+func buildFilter(filter string) (proxyFilter, error) {
+	c := loadFilter(filter)
+	return c.fn, c.err
+}
+
+// matchFilter 代理是否满足筛选条件
+func matchFilter(p *proxyEntry, filter string) bool {
+	fn, err := buildFilter(filter)
+	return err == nil && len(fn([]*proxyEntry{p})) > 0
+}
+
+// checkFilter 检查筛选条件的语法
+func checkFilter(filter string) error {
+	return loadFilter(filter).err
+}
+
+func compileFilter(filter string) *compiledFilter {
+	if isTieredFilter(filter) {
+		tiers, err := parseFilterTiers(filter)
+		if err != nil {
+			return &compiledFilter{err: err}
+		}
+		return &compiledFilter{fn: tiers.filter, tiers: tiers}
+	}
+	if !isFilterExpr(filter) {
+		fn, err := xslice.BuildTagFilter(filter, func(t *proxyEntry) []string {
+			return t.Tags()
+		}, 0)
+		if err != nil {
+			return &compiledFilter{err: &filterError{Filter: filter, Msg: err.Error()}}
+		}
+		return &compiledFilter{fn: fn}
+	}
+	expr, err := parseFilterExpr(filter)
+	if err != nil {
+		return &compiledFilter{err: err}
+	}
+	fn := func(all []*proxyEntry) []*proxyEntry {
+		var result []*proxyEntry
+		for _, p := range all {
+			if expr(p) {
+				result = append(result, p)
+			}
+		}
+		return result
+	}
+	return &compiledFilter{fn: fn}
+}
+
+// isFilterExpr 是否表达式格式
+func isFilterExpr(filter string) bool {
+	return strings.ContainsAny(filter, `:=!<>()"'`) || strings.Contains(filter, "&&") || strings.Contains(filter, "||")
+}
+
+// filterExpr 判断一个代理是否满足条件
+type filterExpr func(p *proxyEntry) bool
+
+// filterStringFields 字符串类型的字段，有多个值时（如 tag），任意一个值满足即可，不区分大小写
+var filterStringFields = map[string]func(p *proxyEntry) []string{
+	"tag": (*proxyEntry).Tags,
+	"scheme": func(p *proxyEntry) []string {
+		return []string{p.Base.URL.Scheme}
+	},
+	"country": func(p *proxyEntry) []string {
+		return []string{p.State.Geo.Load().Country}
+	},
+	"host": func(p *proxyEntry) []string {
+		return []string{p.Base.URL.Hostname()}
+	},
+	"proxy": func(p *proxyEntry) []string {
+		return []string{p.Base.Proxy}
+	},
+	"exitip": func(p *proxyEntry) []string {
+		return []string{p.State.ExitIP.Load()}
+	},
+}
+
+// filterNumberField 数值类型的字段
+type filterNumberField struct {
+	value func(p *proxyEntry) float64
+	parse func(str string) (float64, error)
+}
+
+func parseFilterFloat(str string) (float64, error) {
+	return strconv.ParseFloat(str, 64)
+}
+
+// parseFilterDuration 解析时长，单位毫秒，如 500ms、1.5s，没有单位时为毫秒
+func parseFilterDuration(str string) (float64, error) {
+	if v, err := strconv.ParseFloat(str, 64); err == nil {
+		return v, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	return float64(d) / float64(time.Millisecond), nil
+}
+
+var filterNumberFields = map[string]filterNumberField{
+	// 检查和转发耗时的 EWMA，没有数据时为 0
+	"latency": {
+		value: func(p *proxyEntry) float64 {
+			return float64(p.State.Latency.Load()) / float64(time.Millisecond)
+		},
+		parse: parseFilterDuration,
+	},
+	// 转发的成功率，还没有使用过时为 1，使其有机会被使用
+	"successrate": {
+		value: func(p *proxyEntry) float64 {
+			total := p.State.UsedTotal.Load()
+			if total <= 0 {
+				return 1
+			}
+			return float64(p.State.UsedSuccess.Load()) / float64(total)
+		},
+		parse: parseFilterFloat,
+	},
+	"weight": {
+		value: func(p *proxyEntry) float64 {
+			return float64(p.Base.Weight)
+		},
+		parse: parseFilterFloat,
+	},
+	"inflight": {
+		value: func(p *proxyEntry) float64 {
+			return float64(p.State.InFlight.Load())
+		},
+		parse: parseFilterFloat,
+	},
+	"used": {
+		value: func(p *proxyEntry) float64 {
+			return float64(p.State.UsedTotal.Load())
+		},
+		parse: parseFilterFloat,
+	},
+	"asn": {
+		value: func(p *proxyEntry) float64 {
+			return float64(p.State.Geo.Load().ASN)
+		},
+		parse: parseFilterFloat,
+	},
+}
+
+// 词法单元的类型
+const (
+	filterTokenEOF    = iota
+	filterTokenWord   // 字段名或者值，如 latency、500ms
+	filterTokenString // 引号中的值
+	filterTokenOp     // 运算符和括号
+)
+
+type filterToken struct {
+	kind int
+	text string
+	pos  int // 从 1 开始
+}
+
+func (tk filterToken) desc() string {
+	if tk.kind == filterTokenEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(tk.text)
+}
+
+// filterOps 运算符，两个字符的需要在前面
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "(", ")", ",", ":", "=", "<", ">"}
+
+// filterCompareOps 比较运算符，: 同 =
+var filterCompareOps = []string{":", "=", "==", "!=", "<", "<=", ">", ">="}
+
+func isFilterWordChar(c byte) bool {
+	return c > ' ' && !strings.ContainsRune(`!()&|,:=<>"'`, rune(c))
+}
+
+func tokenizeFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(filter[i+1:], c)
+			if end < 0 {
+				return nil, &filterError{Filter: filter, Pos: i + 1, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenString, text: filter[i+1 : i+1+end], pos: i + 1})
+			i += end + 2
+			continue
+		case isFilterWordChar(c):
+			start := i
+			for i < len(filter) && isFilterWordChar(filter[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenWord, text: filter[start:i], pos: start + 1})
+			continue
+		}
+		var op string
+		for _, o := range filterOps {
+			if strings.HasPrefix(filter[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, &filterError{Filter: filter, Pos: i + 1, Msg: fmt.Sprintf("unexpected %q, use && or ||", string(c))}
+		}
+		tokens = append(tokens, filterToken{kind: filterTokenOp, text: op, pos: i + 1})
+		i += len(op)
+	}
+	return append(tokens, filterToken{kind: filterTokenEOF, pos: len(filter) + 1}), nil
+}
+
+// parseFilterExpr 解析表达式，语法：
+//
+//	expr  = and { "||" and }
+//	and   = unary { "&&" unary }
+//	unary = "!" unary | "(" expr ")" | cond
+//	cond  = field op value | field ["not"] "in" "(" value { "," value } ")" | tag
+//	op    = ":" | "=" | "==" | "!=" | "<" | "<=" | ">" | ">="
+//
+// 单独的一个词为标签，如 us 同 tag:us
+func parseFilterExpr(filter string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	fp := &filterParser{filter: filter, tokens: tokens}
+	expr, err := fp.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tk := fp.peek(); tk.kind != filterTokenEOF {
+		return nil, fp.errorf(tk, "unexpected %s", tk.desc())
+	}
+	return expr, nil
+}
+
+type filterParser struct {
+	filter string
+	tokens []filterToken
+	index  int
+}
+
+func (fp *filterParser) peek() filterToken {
+	return fp.tokens[fp.index]
+}
+
+func (fp *filterParser) next() filterToken {
+	tk := fp.tokens[fp.index]
+	if tk.kind != filterTokenEOF {
+		fp.index++
+	}
+	return tk
+}
+
+// isOp 下一个是否为运算符 op
+func (fp *filterParser) isOp(op string) bool {
+	tk := fp.peek()
+	return tk.kind == filterTokenOp && tk.text == op
+}
+
+func (fp *filterParser) errorf(tk filterToken, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return &filterError{Filter: fp.filter, Pos: tk.pos, Msg: msg}
+}
+
+func (fp *filterParser) parseOr() (filterExpr, error) {
+	left, err := fp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for fp.isOp("||") {
+		fp.next()
+		right, err := fp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *proxyEntry) bool {
+			return l(p) || right(p)
+		}
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseAnd() (filterExpr, error) {
+	left, err := fp.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for fp.isOp("&&") {
+		fp.next()
+		right, err := fp.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *proxyEntry) bool {
+			return l(p) && right(p)
+		}
+	}
+	return left, nil
+}
+
+func (fp *filterParser) parseUnary() (filterExpr, error) {
+	switch {
+	case fp.isOp("!"):
+		fp.next()
+		expr, err := fp.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *proxyEntry) bool {
+			return !expr(p)
+		}, nil
+	case fp.isOp("("):
+		fp.next()
+		expr, err := fp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !fp.isOp(")") {
+			tk := fp.peek()
+			return nil, fp.errorf(tk, "expected \")\", got %s", tk.desc())
+		}
+		fp.next()
+		return expr, nil
+	}
+	return fp.parseCond()
+}
+
+func (fp *filterParser) parseCond() (filterExpr, error) {
+	field := fp.next()
+	if field.kind != filterTokenWord {
+		return nil, fp.errorf(field, "expected field or tag, got %s", field.desc())
+	}
+	var op string
+	var values []filterToken
+	switch tk := fp.peek(); {
+	case tk.kind == filterTokenOp && slices.Contains(filterCompareOps, tk.text):
+		op = fp.next().text
+		value, err := fp.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = []filterToken{value}
+	case tk.kind == filterTokenWord && (strings.EqualFold(tk.text, "in") || strings.EqualFold(tk.text, "not")):
+		fp.next()
+		op = "in"
+		if strings.EqualFold(tk.text, "not") {
+			if in := fp.next(); in.kind != filterTokenWord || !strings.EqualFold(in.text, "in") {
+				return nil, fp.errorf(in, "expected \"in\", got %s", in.desc())
+			}
+			op = "not in"
+		}
+		var err error
+		if values, err = fp.parseList(); err != nil {
+			return nil, err
+		}
+	default:
+		// 单独的一个词为标签
+		return fp.compare(filterToken{kind: filterTokenWord, text: "tag", pos: field.pos}, "=", []filterToken{field})
+	}
+	return fp.compare(field, op, values)
+}
+
+func (fp *filterParser) parseValue() (filterToken, error) {
+	tk := fp.next()
+	if tk.kind != filterTokenWord && tk.kind != filterTokenString {
+		return tk, fp.errorf(tk, "expected value, got %s", tk.desc())
+	}
+	return tk, nil
+}
+
+// parseList 解析 (a,b,c)
+func (fp *filterParser) parseList() ([]filterToken, error) {
+	if !fp.isOp("(") {
+		tk := fp.peek()
+		return nil, fp.errorf(tk, "expected \"(\", got %s", tk.desc())
+	}
+	fp.next()
+	var values []filterToken
+	for {
+		value, err := fp.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if fp.isOp(",") {
+			fp.next()
+			continue
+		}
+		if fp.isOp(")") {
+			fp.next()
+			return values, nil
+		}
+		tk := fp.peek()
+		return nil, fp.errorf(tk, "expected \",\" or \")\", got %s", tk.desc())
+	}
+}
+
+// compare 创建字段比较的条件
+func (fp *filterParser) compare(field filterToken, op string, values []filterToken) (filterExpr, error) {
+	name := strings.ToLower(field.text)
+	negate := op == "!=" || op == "not in"
+
+	if getter, ok := filterStringFields[name]; ok {
+		switch op {
+		case ":", "=", "==", "!=", "in", "not in":
+		default:
+			return nil, fp.errorf(field, "operator %q is not supported by %s", op, field.text)
+		}
+		want := make([]string, len(values))
+		for i, v := range values {
+			want[i] = v.text
+		}
+		return func(p *proxyEntry) bool {
+			for _, got := range getter(p) {
+				for _, w := range want {
+					if strings.EqualFold(got, w) {
+						return !negate
+					}
+				}
+			}
+			return negate
+		}, nil
+	}
+
+	nf, ok := filterNumberFields[name]
+	if !ok {
+		return nil, fp.errorf(field, "unknown field %q", field.text)
+	}
+	want := make([]float64, len(values))
+	for i, v := range values {
+		num, err := nf.parse(v.text)
+		if err != nil {
+			return nil, fp.errorf(v, "invalid value %q for %s", v.text, field.text)
+		}
+		want[i] = num
+	}
+	switch op {
+	case ":", "=", "==", "!=", "in", "not in":
+		return func(p *proxyEntry) bool {
+			got := nf.value(p)
+			for _, w := range want {
+				if got == w {
+					return !negate
+				}
+			}
+			return negate
+		}, nil
+	}
+	w := want[0]
+	var cmp func(got float64) bool
+	switch op {
+	case "<":
+		cmp = func(got float64) bool { return got < w }
+	case "<=":
+		cmp = func(got float64) bool { return got <= w }
+	case ">":
+		cmp = func(got float64) bool { return got > w }
+	default:
+		cmp = func(got float64) bool { return got >= w }
+	}
+	return func(p *proxyEntry) bool {
+		return cmp(nf.value(p))
+	}, nil
+}
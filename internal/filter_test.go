@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// newFilterTestProxies a: us、residential、http；b: us、dc、socks5；c: de、dc、flaky、socks5
+func newFilterTestProxies(t *testing.T) []*proxyEntry {
+	t.Helper()
+	a := newProxy("http://10.0.0.1:8080")
+	a.Base.Tags = []string{"us", "residential"}
+	a.Base.Weight = 1
+	a.State.Latency.Observe(100 * time.Millisecond)
+	a.State.UsedTotal.Store(10)
+	a.State.UsedSuccess.Store(10)
+
+	b := newProxy("socks5://10.0.0.2:1080")
+	b.Base.Tags = []string{"us", "dc"}
+	b.Base.Weight = 2
+	b.State.Latency.Observe(600 * time.Millisecond)
+	b.State.UsedTotal.Store(10)
+	b.State.UsedSuccess.Store(5)
+	b.State.Geo.Store(geoInfo{Country: "US", ASN: 64500})
+
+	c := newProxy("socks5://10.0.0.3:1080")
+	c.Base.Tags = []string{"de", "dc", "flaky"}
+	c.Base.Weight = 3
+	c.State.Latency.Observe(2 * time.Second)
+	c.State.Geo.Store(geoInfo{Country: "DE", ASN: 64501})
+	return []*proxyEntry{a, b, c}
+}
+
+func filterNames(list []*proxyEntry, all []*proxyEntry) string {
+	var names []byte
+	for _, p := range list {
+		names = append(names, byte('a'+slices.Index(all, p)))
+	}
+	return string(names)
+}
+
+func TestFilterExpr(t *testing.T) {
+	all := newFilterTestProxies(t)
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{filter: "tag:us", want: "ab"},
+		{filter: "tag=US", want: "ab"},
+		{filter: `tag:"dc"`, want: "bc"},
+		{filter: "us && dc", want: "b"},
+
+		// && 优先于 ||
+		{filter: "tag:de || tag:us && tag:residential", want: "ac"},
+		{filter: "tag:us && tag:residential || tag:de", want: "ac"},
+		{filter: "(tag:de || tag:us) && tag:dc", want: "bc"},
+		{filter: "tag:us && (tag:residential || tag:flaky)", want: "a"},
+		{filter: "((tag:us))", want: "ab"},
+
+		{filter: "!tag:flaky", want: "ab"},
+		{filter: "!!tag:flaky", want: "c"},
+		{filter: "!(tag:us && tag:dc)", want: "ac"},
+		{filter: "tag!=us", want: "c"},
+		{filter: "!tag:us || tag:residential", want: "ac"},
+
+		{filter: "latency<500ms", want: "a"},
+		{filter: "latency<=600", want: "ab"},
+		{filter: "latency>1.5s", want: "c"},
+		{filter: "latency>=600ms && latency<1s", want: "b"},
+		{filter: "successRate>0.9", want: "ac"},
+		{filter: "successrate<1", want: "b"},
+		{filter: "weight==2", want: "b"},
+		{filter: "weight!=2", want: "ac"},
+		{filter: "weight in (1,3)", want: "ac"},
+		{filter: "weight not in (1, 3)", want: "b"},
+		{filter: "asn=64500", want: "b"},
+
+		{filter: "scheme in (socks5,ss)", want: "bc"},
+		{filter: "scheme NOT IN (socks5)", want: "a"},
+		{filter: "country!=CN && country:de", want: "c"},
+		{filter: "host=10.0.0.1", want: "a"},
+		{filter: "proxy:'socks5://10.0.0.3:1080'", want: "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			if !isFilterExpr(tt.filter) {
+				t.Fatalf("isFilterExpr(%q)=false", tt.filter)
+			}
+			fn, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filterNames(fn(all), all); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterExprError(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+	}{
+		{filter: "tag:", pos: 5},
+		{filter: "(tag:us", pos: 8},
+		{filter: "tag:us)", pos: 7},
+		{filter: "tag:us &&", pos: 10},
+		{filter: "&& tag:us", pos: 1},
+		{filter: "tag:us & tag:dc", pos: 8},
+		{filter: "tag:us | tag:dc", pos: 8},
+		{filter: `tag:"us`, pos: 5},
+		{filter: "foo:bar", pos: 1},
+		{filter: "latency<abc", pos: 9},
+		{filter: "tag<us", pos: 1},
+		{filter: "weight>1 && weight in 1", pos: 23},
+		{filter: "weight in (1,2", pos: 15},
+		{filter: "weight in ()", pos: 12},
+		{filter: "weight not (1)", pos: 12},
+		{filter: "!", pos: 2},
+		{filter: "()", pos: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			err := checkFilter(tt.filter)
+			if err == nil {
+				t.Fatal("expect error")
+			}
+			fe, ok := err.(*filterError)
+			if !ok {
+				t.Fatalf("expect *filterError, got %T: %v", err, err)
+			}
+			if fe.Pos != tt.pos {
+				t.Fatalf("Pos=%d, want %d: %v", fe.Pos, tt.pos, err)
+			}
+		})
+	}
+}
+
+// 原有的标签格式：tag1 & tag2,tag3,[ANY]
+func TestFilterTags(t *testing.T) {
+	all := newFilterTestProxies(t)
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{filter: "", want: "abc"},
+		{filter: "us", want: "ab"},
+		{filter: "us&residential", want: "a"},
+		{filter: "us & dc", want: "b"},
+		{filter: "nosuch,de", want: "c"},
+		{filter: "nosuch,[ANY]", want: "abc"},
+		{filter: "nosuch", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			if isFilterExpr(tt.filter) {
+				t.Fatalf("isFilterExpr(%q)=true", tt.filter)
+			}
+			fn, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filterNames(fn(all), all); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if !matchFilter(all[0], "us&residential,de") || matchFilter(all[1], "residential,de") {
+		t.Fatal("matchFilter failed")
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/xanygo/anygo/xattr"
+)
+
+// geoIPRecord mmdb 中需要的字段，兼容 MaxMind 的 Country、City 和 ASN 数据库
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoInfo 一个 IP 的地理位置信息
+type geoInfo struct {
+	IP      string
+	Country string // 国家代码，如 US
+	ASN     uint
+	ASOrg   string
+}
+
+// Tags 自动添加到代理上的标签，如 US、AS13335
+func (g geoInfo) Tags() []string {
+	var tags []string
+	if g.Country != "" {
+		tags = append(tags, g.Country)
+	}
+	if g.ASN > 0 {
+		tags = append(tags, "AS"+strconv.FormatUint(uint64(g.ASN), 10))
+	}
+	return tags
+}
+
+type geoIPFile struct {
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// geoIPDB 本地的 GeoIP 数据库，支持多个文件（如 Country 和 ASN 分开的），运行时可重新加载
+type geoIPDB struct {
+	mux   sync.RWMutex
+	files []*geoIPFile
+}
+
+var geoIP = &geoIPDB{}
+
+func getGeoIPFiles() []string {
+	var result []string
+	for _, name := range getAppConfig().GeoIPFiles {
+		if name == "" {
+			continue
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(xattr.ConfDir(), name)
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+// Reload 重新加载所有的数据库文件，加载失败的文件继续使用之前的
+func (db *geoIPDB) Reload() error {
+	return db.load(true)
+}
+
+// reloadIfChanged 文件有更新时重新加载
+func (db *geoIPDB) reloadIfChanged() {
+	db.load(false)
+}
+
+func (db *geoIPDB) load(force bool) error {
+	db.mux.RLock()
+	old := make(map[string]*geoIPFile, len(db.files))
+	for _, f := range db.files {
+		old[f.path] = f
+	}
+	db.mux.RUnlock()
+
+	var lastErr error
+	var changed bool
+	paths := getGeoIPFiles()
+	files := make([]*geoIPFile, 0, len(paths))
+	for _, path := range paths {
+		prev := old[path]
+		info, err := os.Stat(path)
+		if err != nil {
+			lastErr = err
+			log.Println("stat GeoIP file failed:", err)
+			if prev != nil {
+				files = append(files, prev)
+			}
+			continue
+		}
+		if !force && prev != nil && info.ModTime().Equal(prev.modTime) {
+			files = append(files, prev)
+			continue
+		}
+		// 不使用 mmap，避免重新加载时，正在查询的 reader 被释放
+		bf, err := os.ReadFile(path)
+		var reader *maxminddb.Reader
+		if err == nil {
+			reader, err = maxminddb.FromBytes(bf)
+		}
+		if err != nil {
+			lastErr = err
+			log.Println("load GeoIP file failed:", path, err)
+			if prev != nil {
+				files = append(files, prev)
+			}
+			continue
+		}
+		log.Println("load GeoIP file success:", path, reader.Metadata.DatabaseType)
+		files = append(files, &geoIPFile{path: path, modTime: info.ModTime(), reader: reader})
+		changed = true
+	}
+	if changed || len(files) != len(old) {
+		db.mux.Lock()
+		db.files = files
+		db.mux.Unlock()
+		refreshProxiesGeo()
+	}
+	return lastErr
+}
+
+// refreshProxiesGeo 数据库更新后，重新计算所有代理的国家和 ASN 标签
+func refreshProxiesGeo() {
+	if pool == nil {
+		return
+	}
+	for _, one := range pool.all.All() {
+		updateProxyGeo(one)
+	}
+}
+
+// Enabled 是否有可用的数据库
+func (db *geoIPDB) Enabled() bool {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return len(db.files) > 0
+}
+
+// Lookup 查询 IP 的国家和 ASN，多个数据库时，使用第一个有值的
+func (db *geoIPDB) Lookup(addr netip.Addr) geoInfo {
+	info := geoInfo{IP: addr.String()}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	ip := net.IP(addr.Unmap().AsSlice())
+	for _, f := range db.files {
+		var rec geoIPRecord
+		if err := f.reader.Lookup(ip, &rec); err != nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = rec.Country.ISOCode
+			if info.Country == "" {
+				info.Country = rec.RegisteredCountry.ISOCode
+			}
+		}
+		if info.ASN == 0 && rec.ASN > 0 {
+			info.ASN = rec.ASN
+			info.ASOrg = rec.ASOrg
+		}
+	}
+	return info
+}
+
+// Files 用于状态展示
+func (db *geoIPDB) Files() []map[string]any {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	result := make([]map[string]any, 0, len(db.files))
+	for _, f := range db.files {
+		result = append(result, map[string]any{
+			"Path":         f.path,
+			"ModTime":      f.modTime,
+			"DatabaseType": f.reader.Metadata.DatabaseType,
+			"BuildTime":    time.Unix(int64(f.reader.Metadata.BuildEpoch), 0),
+		})
+	}
+	return result
+}
+
+// lookupHostCountry 查询目标地址所在的国家，域名会先在本地解析
+func lookupHostCountry(ctx context.Context, host string) string {
+	if !geoIP.Enabled() {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil || len(addrs) == 0 {
+			return ""
+		}
+		addr = addrs[0]
+	}
+	return geoIP.Lookup(addr).Country
+}
+
+// parseExitIPBody 从响应 Body 中解析 IP，支持纯文本的 IP，
+// 以及含有 ip 或 origin 字段的 JSON，如 {"ip":"1.2.3.4"}、httpbin 的 {"origin":"1.2.3.4"}
+func parseExitIPBody(body []byte) string {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '{' {
+		var data map[string]any
+		if json.Unmarshal(body, &data) != nil {
+			return ""
+		}
+		for key, val := range data {
+			str, ok := val.(string)
+			if !ok || !slices.Contains([]string{"ip", "origin"}, strings.ToLower(key)) {
+				continue
+			}
+			// httpbin 经过多层代理时 origin 为逗号分隔的多个 IP
+			str, _, _ = strings.Cut(str, ",")
+			if addr, err := netip.ParseAddr(strings.TrimSpace(str)); err == nil {
+				return addr.Unmap().String()
+			}
+		}
+		return ""
+	}
+	if addr, err := netip.ParseAddr(string(body)); err == nil {
+		return addr.Unmap().String()
+	}
+	return ""
+}
+
+// updateProxyGeo 根据代理的出口 IP，更新代理的国家和 ASN 标签
+func updateProxyGeo(proxy *proxyEntry) {
+	exitIP := proxy.State.ExitIP.Load()
+	if exitIP == "" || !geoIP.Enabled() {
+		return
+	}
+	addr, err := netip.ParseAddr(exitIP)
+	if err != nil {
+		return
+	}
+	info := geoIP.Lookup(addr)
+	proxy.State.Geo.Store(info)
+	updateAutoTags(proxy)
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// isIdempotent 是否幂等的请求，只有幂等的请求才允许对冲
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+type hedgeResult[T any] struct {
+	index int
+	proxy *proxyEntry
+	value T
+	err   error
+}
+
+// hedge 通过多个不同的代理执行同一个操作，每间隔 delay 启动一个（前一个失败时立即启动下一个），
+// 返回最先成功的结果，并取消其他的。返回的 cancel 需要在使用完结果后调用。
+// release 用于释放落后的成功结果，如关闭连接。
+func hedge[T any](ctx context.Context, proxies []*proxyEntry, delay time.Duration,
+	fn func(ctx context.Context, p *proxyEntry) (T, error), release func(T)) (*proxyEntry, T, context.CancelFunc, error) {
+	results := make(chan hedgeResult[T], len(proxies))
+	cancels := make([]context.CancelFunc, 0, len(proxies))
+
+	// 取消除 winner 外的所有请求，lost 为 true 时记录到代理的统计中
+	finish := func(winner int, lost bool) {
+		for i, cancel := range cancels {
+			if i == winner {
+				continue
+			}
+			cancel()
+			if lost {
+				proxies[i].State.HedgeLoss.Add(1)
+			}
+		}
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var done int
+	var lastErr error
+	var zero T
+	for done < len(proxies) {
+		var next <-chan time.Time
+		if len(cancels) < len(proxies) {
+			next = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			finish(-1, false)
+			go drainHedge(results, len(cancels)-done, release)
+			return nil, zero, nil, context.Cause(ctx)
+		case <-next:
+			index := len(cancels)
+			one := proxies[index]
+			hctx, cancel := context.WithCancel(ctx)
+			cancels = append(cancels, cancel)
+			go func() {
+				val, err := fn(hctx, one)
+				results <- hedgeResult[T]{index: index, proxy: one, value: val, err: err}
+			}()
+			if len(cancels) < len(proxies) {
+				timer.Reset(delay)
+			}
+		case ret := <-results:
+			done++
+			if ret.err != nil {
+				lastErr = ret.err
+				if len(cancels) < len(proxies) {
+					timer.Reset(0)
+				}
+				continue
+			}
+			ret.proxy.State.HedgeWin.Add(1)
+			finish(ret.index, true)
+			go drainHedge(results, len(cancels)-done, release)
+			return ret.proxy, ret.value, cancels[ret.index], nil
+		}
+	}
+	finish(-1, true)
+	return nil, zero, nil, lastErr
+}
+
+// drainHedge 读取剩余的结果，并释放其中成功的
+func drainHedge[T any](results <-chan hedgeResult[T], pending int, release func(T)) {
+	for i := 0; i < pending; i++ {
+		ret := <-results
+		if ret.err == nil {
+			release(ret.value)
+		}
+	}
+}
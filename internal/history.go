@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+)
+
+// 历史记录的来源
+const (
+	historyCheck = "check" // 检查
+	historyRelay = "relay" // 转发请求或者建立隧道
+)
+
+// historyEntry 一次检查或者转发的结果
+type historyEntry struct {
+	Time    time.Time     `json:"Time"`
+	Source  string        `json:"Source"` // check 或 relay
+	OK      bool          `json:"OK"`
+	Status  int           `json:"Status,omitempty"`  // 响应的状态码，隧道为 0
+	Connect time.Duration `json:"Connect,omitempty"` // 连接到代理（含代理协议握手）的耗时，检查时为 0
+	Latency time.Duration `json:"Latency"`           // 检查为探测的耗时，转发为收到响应头或者隧道建立的耗时
+	Error   string        `json:"Error,omitempty"`
+}
+
+// getHistorySize 每个代理保存的最近的检查和转发结果数，app.yml 中的 HistorySize，默认 200
+func getHistorySize() int {
+	num := xattr.GetDefault[int]("HistorySize", 200)
+	if num <= 0 {
+		return 200
+	}
+	return num
+}
+
+// proxyHistory 最近的检查和转发结果，写满后循环使用
+type proxyHistory struct {
+	mux   sync.Mutex
+	items []historyEntry
+	start int // 最早的一条的位置
+}
+
+func (h *proxyHistory) Add(e historyEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	size := getHistorySize()
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if cap(h.items) != size {
+		// 第一次使用，或者 HistorySize 变化了
+		list := h.listLocked()
+		h.items = append(make([]historyEntry, 0, size), list[max(len(list)-size, 0):]...)
+		h.start = 0
+	}
+	if len(h.items) < size {
+		h.items = append(h.items, e)
+		return
+	}
+	h.items[h.start] = e
+	h.start = (h.start + 1) % size
+}
+
+func (h *proxyHistory) listLocked() []historyEntry {
+	result := make([]historyEntry, 0, len(h.items))
+	result = append(result, h.items[h.start:]...)
+	return append(result, h.items[:h.start]...)
+}
+
+// List 按照时间顺序返回
+func (h *proxyHistory) List() []historyEntry {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.listLocked()
+}
+
+// historySummary 历史记录的汇总
+type historySummary struct {
+	Checks       int     `json:"Checks"`
+	Uptime       float64 `json:"Uptime"` // 检查通过的百分比
+	Relays       int     `json:"Relays"`
+	RelaySuccess float64 `json:"RelaySuccess"` // 转发成功的百分比
+
+	P50 time.Duration `json:"P50"` // 成功的检查和转发的耗时的中位数
+	P95 time.Duration `json:"P95"`
+}
+
+func summarizeHistory(list []historyEntry) historySummary {
+	var s historySummary
+	var checkOK, relayOK int
+	var latencies []time.Duration
+	for _, e := range list {
+		switch e.Source {
+		case historyCheck:
+			s.Checks++
+			if e.OK {
+				checkOK++
+			}
+		case historyRelay:
+			s.Relays++
+			if e.OK {
+				relayOK++
+			}
+		}
+		if e.OK {
+			latencies = append(latencies, e.Latency)
+		}
+	}
+	if s.Checks > 0 {
+		s.Uptime = math.Round(float64(checkOK)*1000/float64(s.Checks)) / 10
+	}
+	if s.Relays > 0 {
+		s.RelaySuccess = math.Round(float64(relayOK)*1000/float64(s.Relays)) / 10
+	}
+	slices.Sort(latencies)
+	s.P50 = percentile(latencies, 0.5)
+	s.P95 = percentile(latencies, 0.95)
+	return s
+}
+
+// percentile 已排序的 list 的百分位数（最近秩法）
+func percentile(list []time.Duration, p float64) time.Duration {
+	if len(list) == 0 {
+		return 0
+	}
+	index := int(math.Ceil(p*float64(len(list)))) - 1
+	return list[max(index, 0)]
+}
+
+// recordRelayHistory 记录一次转发的结果，被取消的不记录
+func recordRelayHistory(ctx context.Context, p *proxyEntry, e historyEntry) {
+	if !e.OK && ctx.Err() != nil {
+		return
+	}
+	e.Source = historyRelay
+	p.State.History.Add(e)
+}
+
+// sparkline 历史记录的耗时折线图，用于详情页面
+type sparkline struct {
+	Width  int
+	Height int
+	Points string       // polyline 的 points
+	Fails  []sparkPoint // 失败的点
+	Max    time.Duration
+}
+
+type sparkPoint struct {
+	X, Y float64
+}
+
+// newSparkline 成功的按照耗时连线，失败的标记在底部
+func newSparkline(list []historyEntry, width int, height int) sparkline {
+	sl := sparkline{Width: width, Height: height}
+	for _, e := range list {
+		if e.OK {
+			sl.Max = max(sl.Max, e.Latency)
+		}
+	}
+	step := float64(width)
+	if len(list) > 1 {
+		step = float64(width) / float64(len(list)-1)
+	}
+	var points []string
+	for i, e := range list {
+		pt := sparkPoint{X: math.Round(float64(i)*step*10) / 10, Y: float64(height) - 2}
+		if !e.OK {
+			sl.Fails = append(sl.Fails, pt)
+			continue
+		}
+		if sl.Max > 0 {
+			pt.Y -= math.Round(float64(e.Latency)/float64(sl.Max)*float64(height-4)*10) / 10
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", pt.X, pt.Y))
+	}
+	sl.Points = strings.Join(points, " ")
+	return sl
+}
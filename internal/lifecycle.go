@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"strconv"
+	"time"
+)
+
+// 代理的生命周期状态：new → active → degraded → quarantined → removed，
+// 检查通过后回到 active，只有 active 的代理会被使用
+const (
+	stateNew         = "new"         // 还未检查过
+	stateActive      = "active"      // 可用，连续失败次数未达到 DegradedAfter 时仍为 active
+	stateDegraded    = "degraded"    // 连续失败次数达到 DegradedAfter，不再使用，按照退避的间隔检查
+	stateQuarantined = "quarantined" // 连续失败次数达到 QuarantineAfter，按照 CheckMaxInterval 检查，超过 Retention 后删除
+	stateRemoved     = "removed"     // 已删除，只有动态添加的代理会被删除
+)
+
+// eventStateChanged 代理的生命周期状态变化了
+const eventStateChanged = "state-changed"
+
+// lifecycleConfig 生命周期配置，app.yml 中的 Lifecycle
+type lifecycleConfig struct {
+	DegradedAfter   int `yaml:"DegradedAfter"`   // 连续失败多少次后进入 degraded，默认 2，偶尔一次失败的 active 代理仍然保留
+	QuarantineAfter int `yaml:"QuarantineAfter"` // 连续失败多少次后进入 quarantined，默认 5
+	Retention       int `yaml:"Retention"`       // 动态添加的代理 quarantined 多久后删除，单位秒，默认 86400，-1 为不删除
+}
+
+func getLifecycleConfig() lifecycleConfig {
+	cfg := getAppConfig().Lifecycle
+	if cfg.DegradedAfter <= 0 {
+		cfg.DegradedAfter = 2
+	}
+	if cfg.QuarantineAfter <= 0 {
+		cfg.QuarantineAfter = 5
+	}
+	cfg.QuarantineAfter = max(cfg.QuarantineAfter, cfg.DegradedAfter)
+	if cfg.Retention == 0 {
+		cfg.Retention = 86400
+	}
+	return cfg
+}
+
+// LifecycleState 生命周期状态
+func (p *proxyEntry) LifecycleState() string {
+	if s := p.State.Lifecycle.Load(); s != "" {
+		return s
+	}
+	return stateNew
+}
+
+// RemoveAt quarantined 的动态代理将被删除的时间，不会被删除时为空
+func (p *proxyEntry) RemoveAt() time.Time {
+	cfg := getLifecycleConfig()
+	if p.LifecycleState() != stateQuarantined || cfg.Retention < 0 || pool.dyn.Get(p.Base.Proxy) == nil {
+		return time.Time{}
+	}
+	return p.State.LifecycleSince.Load().Add(time.Duration(cfg.Retention) * time.Second)
+}
+
+// setLifecycleState 修改生命周期状态，并记录 state-changed 事件
+func setLifecycleState(p *proxyEntry, state string, reason string) {
+	old := p.LifecycleState()
+	if old == state {
+		return
+	}
+	p.State.Lifecycle.Store(state)
+	p.State.LifecycleSince.Store(time.Now())
+	events.Add(proxyEvent{
+		Type:  eventStateChanged,
+		Proxy: p.Base.Proxy,
+		Old:   old,
+		New:   state,
+		Msg:   reason,
+	})
+}
+
+// applyCheckResult 根据检查结果和连续失败次数更新状态，以及是否在 active 中
+func (p *ProxyPool) applyCheckResult(one *proxyEntry, ok bool) {
+	if ok {
+		setLifecycleState(one, stateActive, "check passed")
+		p.active.Add(one)
+		return
+	}
+	cfg := getLifecycleConfig()
+	fails := one.State.CheckFails.Load()
+	reason := strconv.FormatInt(fails, 10) + " consecutive check failures: " + one.State.LastCheckMsg.Load()
+	switch {
+	case fails >= int64(cfg.QuarantineAfter):
+		setLifecycleState(one, stateQuarantined, reason)
+		p.active.Remove(one)
+	case fails >= int64(cfg.DegradedAfter):
+		setLifecycleState(one, stateDegraded, reason)
+		p.active.Remove(one)
+	case one.LifecycleState() == stateActive:
+		// 偶尔失败的仍然保留在 active 中
+	default:
+		p.active.Remove(one)
+	}
+}
+
+// removeExpired 删除 quarantined 超过 Retention 的动态代理
+func (p *ProxyPool) removeExpired() {
+	now := time.Now()
+	for _, one := range p.dyn.All() {
+		if at := one.RemoveAt(); !at.IsZero() && now.After(at) {
+			p.removeProxy(one, "quarantined for more than Retention")
+		}
+	}
+}
+
+// removeProxy 从代理池中删除，状态为 removed
+func (p *ProxyPool) removeProxy(one *proxyEntry, reason string) {
+	p.dyn.Remove(one)
+	p.all.Remove(one)
+	p.active.Remove(one)
+	p.checker.Remove(one)
+	setLifecycleState(one, stateRemoved, reason)
+}
+
+// restoreProxy 手动恢复代理：清除失败次数，状态改为 new 并立即检查，检查通过后即为 active
+func (p *ProxyPool) restoreProxy(one *proxyEntry) {
+	one.State.CheckFails.Store(0)
+	one.State.NextCheck.Store(time.Time{})
+	setLifecycleState(one, stateNew, "restored manually")
+	p.checker.Submit(one)
+}
+
+// quarantined 所有 quarantined 的代理
+func (p *ProxyPool) quarantined() []*proxyEntry {
+	var result []*proxyEntry
+	p.all.Range(func(_ string, one *proxyEntry) bool {
+		if one.LifecycleState() == stateQuarantined {
+			result = append(result, one)
+		}
+		return true
+	})
+	return result
+}
@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xsync"
+)
+
+// requestLimitConfig 并发数和请求频率的限制，0 为不限制
+type requestLimitConfig struct {
+	MaxInFlight int64   `yaml:"MaxInFlight"` // 同时进行中的请求和隧道数
+	MaxRPS      float64 `yaml:"MaxRPS"`      // 每秒的请求数，可以为小数，如 0.5 即每 2 秒 1 个
+}
+
+func (c requestLimitConfig) IsZero() bool {
+	return c.MaxInFlight <= 0 && c.MaxRPS <= 0
+}
+
+// limitsConfig app.yml 中的 Limits 配置
+type limitsConfig struct {
+	User   requestLimitConfig `yaml:"User"`   // 每个用户的默认限制，users.yml 中可以为用户单独配置
+	Proxy  requestLimitConfig `yaml:"Proxy"`  // 每个代理的限制，达到限制的代理在选择时会被跳过
+	Domain requestLimitConfig `yaml:"Domain"` // 每个目标域名的限制，达到限制时等待（礼貌抓取）
+}
+
+var (
+	errTooManyInFlight = errors.New("too many in-flight requests")
+	errTooManyRequests = errors.New("too many requests per second")
+	errProxySaturated  = errors.New("all proxies are saturated")
+)
+
+// usageLimiter 一个用户、代理或者目标域名的并发数和请求频率限制
+type usageLimiter struct {
+	key string
+
+	mux      sync.Mutex
+	cfg      requestLimitConfig
+	bucket   *tokenBucket  // 请求频率，为 nil 时不限制
+	inFlight int64         // 进行中的数量
+	wake     chan struct{} // 有释放时 close，通知等待者
+
+	total    atomic.Int64 // 总数
+	rejected atomic.Int64 // 被拒绝的数量
+	lastUsed xsync.TimeStamp
+}
+
+func newUsageLimiter(key string, cfg requestLimitConfig) *usageLimiter {
+	l := &usageLimiter{key: key}
+	l.setConfig(cfg)
+	return l
+}
+
+// setConfig 配置变化时更新，需要在锁内调用
+func (l *usageLimiter) setConfig(cfg requestLimitConfig) {
+	if l.cfg == cfg {
+		return
+	}
+	l.cfg = cfg
+	l.bucket = nil
+	if cfg.MaxRPS > 0 {
+		l.bucket = &tokenBucket{rate: cfg.MaxRPS, tokens: max(cfg.MaxRPS, 1), last: time.Now()}
+	}
+}
+
+// acquire 占用一个名额，wait 为 true 时等待直到有空闲的名额或者 ctx 取消，否则立即返回错误。
+// 成功后需要调用 release
+func (l *usageLimiter) acquire(ctx context.Context, wait bool) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mux.Lock()
+		if l.cfg.MaxInFlight <= 0 || l.inFlight < l.cfg.MaxInFlight {
+			l.inFlight++
+			l.mux.Unlock()
+			break
+		}
+		if !wait {
+			l.mux.Unlock()
+			l.rejected.Add(1)
+			return errTooManyInFlight
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		wake := l.wake
+		l.mux.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+
+	l.mux.Lock()
+	bucket := l.bucket
+	l.mux.Unlock()
+	if wait {
+		if !bucket.wait(1, ctx.Done()) {
+			l.release()
+			return context.Cause(ctx)
+		}
+	} else if !bucket.allow(1) {
+		l.release()
+		l.rejected.Add(1)
+		return errTooManyRequests
+	}
+	l.total.Add(1)
+	return nil
+}
+
+// use 占用一个名额，不检查限制，用于已经选择了的代理
+func (l *usageLimiter) use() {
+	if l == nil {
+		return
+	}
+	l.mux.Lock()
+	l.inFlight++
+	bucket := l.bucket
+	l.mux.Unlock()
+	bucket.reserve(1)
+	l.total.Add(1)
+}
+
+func (l *usageLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inFlight--
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// saturated 是否已达到限制
+func (l *usageLimiter) saturated() bool {
+	if l == nil {
+		return false
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.cfg.MaxInFlight > 0 && l.inFlight >= l.cfg.MaxInFlight {
+		return true
+	}
+	return !l.bucket.available(1)
+}
+
+func (l *usageLimiter) isIdle(now time.Time) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.inFlight <= 0 && now.Sub(l.lastUsed.Load()) > 10*time.Minute
+}
+
+// Usage 当前的使用情况，用于 /status 展示
+func (l *usageLimiter) Usage() map[string]any {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return map[string]any{
+		"Key":         l.key,
+		"InFlight":    l.inFlight,
+		"MaxInFlight": l.cfg.MaxInFlight,
+		"MaxRPS":      l.cfg.MaxRPS,
+		"Total":       l.total.Load(),
+		"Rejected":    l.rejected.Load(),
+	}
+}
+
+// limitGroup 一类限制，如所有的用户
+type limitGroup struct {
+	config func(key string) requestLimitConfig
+
+	mux   sync.Mutex
+	items map[string]*usageLimiter
+}
+
+// get 返回 key 对应的限制，没有配置限制并且之前也未使用时返回 nil
+func (g *limitGroup) get(key string) *usageLimiter {
+	cfg := g.config(key)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	l, ok := g.items[key]
+	if !ok {
+		if cfg.IsZero() {
+			return nil
+		}
+		l = newUsageLimiter(key, cfg)
+		g.items[key] = l
+	}
+	// 在锁内更新，避免被 clean 删除
+	l.lastUsed.Store(time.Now())
+	l.mux.Lock()
+	// 限制被取消后，仍然返回，使进行中的可以正常释放，之后由 clean 删除
+	l.setConfig(cfg)
+	l.mux.Unlock()
+	return l
+}
+
+// clean 清理长时间未使用的
+func (g *limitGroup) clean() {
+	now := time.Now()
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for key, l := range g.items {
+		if l.isIdle(now) {
+			delete(g.items, key)
+		}
+	}
+}
+
+// Usage 使用中的，按照进行中的数量倒序
+func (g *limitGroup) Usage() []map[string]any {
+	g.mux.Lock()
+	items := make([]*usageLimiter, 0, len(g.items))
+	for _, l := range g.items {
+		items = append(items, l)
+	}
+	g.mux.Unlock()
+	result := make([]map[string]any, 0, len(items))
+	for _, l := range items {
+		result = append(result, l.Usage())
+	}
+	slices.SortFunc(result, func(a, b map[string]any) int {
+		if d := b["InFlight"].(int64) - a["InFlight"].(int64); d != 0 {
+			return int(d)
+		}
+		return strings.Compare(a["Key"].(string), b["Key"].(string))
+	})
+	return result
+}
+
+var requestLimits = struct {
+	user   *limitGroup
+	proxy  *limitGroup
+	domain *limitGroup
+}{
+	user: &limitGroup{
+		config: func(key string) requestLimitConfig {
+			if u := getUser(key); u != nil && !u.requestLimitConfig.IsZero() {
+				return u.requestLimitConfig
+			}
+			return getAppConfig().Limits.User
+		},
+		items: make(map[string]*usageLimiter),
+	},
+	proxy: &limitGroup{
+		config: func(string) requestLimitConfig {
+			return getAppConfig().Limits.Proxy
+		},
+		items: make(map[string]*usageLimiter),
+	},
+	domain: &limitGroup{
+		config: func(string) requestLimitConfig {
+			return getAppConfig().Limits.Domain
+		},
+		items: make(map[string]*usageLimiter),
+	},
+}
+
+func cleanRequestLimits() {
+	requestLimits.user.clean()
+	requestLimits.proxy.clean()
+	requestLimits.domain.clean()
+}
+
+func requestLimitsUsage() map[string]any {
+	return map[string]any{
+		"User":   requestLimits.user.Usage(),
+		"Proxy":  requestLimits.proxy.Usage(),
+		"Domain": requestLimits.domain.Usage(),
+	}
+}
+
+// acquireUserLimit 占用用户的一个名额，超过限制时返回错误，成功后需要调用返回的 release
+func acquireUserLimit(ctx context.Context, name string) (release func(), err error) {
+	l := requestLimits.user.get(name)
+	if err = l.acquire(ctx, false); err != nil {
+		return nil, err
+	}
+	return l.release, nil
+}
+
+// writeTooManyRequests 返回 429
+func writeTooManyRequests(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(err.Error()))
+}
+
+// waitDomainLimit 等待目标域名的名额，用于控制访问同一个网站的并发和频率，成功后需要调用返回的 release
+func waitDomainLimit(ctx context.Context, host string) (release func(), err error) {
+	l := requestLimits.domain.get(strings.ToLower(host))
+	if err = l.acquire(ctx, true); err != nil {
+		return nil, err
+	}
+	return l.release, nil
+}
+
+// proxySaturated 代理是否已达到限制，选择代理时会跳过
+func proxySaturated(p *proxyEntry) bool {
+	if getAppConfig().Limits.Proxy.IsZero() {
+		return false
+	}
+	return requestLimits.proxy.get(p.Base.Proxy).saturated()
+}
+
+// useProxyLimit 记录使用代理，返回的 release 需要在使用结束后调用
+func useProxyLimit(p *proxyEntry) (release func()) {
+	p.State.InFlight.Add(1)
+	p.State.LastUsed.Store(time.Now())
+	l := requestLimits.proxy.get(p.Base.Proxy)
+	l.use()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.State.InFlight.Add(-1)
+			l.release()
+		})
+	}
+}
+
+// releaseBody 关闭时调用 release，用于释放代理的名额
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// releaseRWBody 协议升级（101）后的 Body 是 io.ReadWriteCloser，需要保留 Write
+type releaseRWBody struct {
+	releaseBody
+	w io.Writer
+}
+
+func (b *releaseRWBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func newReleaseBody(body io.ReadCloser, release func()) io.ReadCloser {
+	rb := releaseBody{ReadCloser: body, release: release}
+	if w, ok := body.(io.Writer); ok {
+		return &releaseRWBody{releaseBody: rb, w: w}
+	}
+	return &rb
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xctx"
+	"github.com/xanygo/anygo/xattr"
+)
+
+const mainListener = "main"
+
+// listenerConfig 一个监听端口的配置，以及通过该端口使用代理时的默认参数
+// Name 为 main 的配置对应 Listen.main，不需要填写 Addr
+type listenerConfig struct {
+	Name string `yaml:"Name"`
+	Addr string `yaml:"Addr"` // 监听地址，如 127.0.0.1:8129
+
+	Hedge      int `yaml:"Hedge"`      // 默认的对冲请求数，小于 2 时不对冲
+	HedgeDelay int `yaml:"HedgeDelay"` // 对冲请求的启动间隔，单位毫秒，可选
+
+	Strategy string `yaml:"Strategy"` // 代理的选择策略，可选，默认使用全局的 SelectStrategy
+
+	tunnelTimeoutConfig `yaml:",inline"`
+}
+
+func (lc *listenerConfig) getHedgeDelay() time.Duration {
+	if lc.HedgeDelay > 0 {
+		return time.Duration(lc.HedgeDelay) * time.Millisecond
+	}
+	return getHedgeDelay()
+}
+
+// getListeners 返回所有的监听配置，第一个总是 main
+func getListeners() []*listenerConfig {
+	main := &listenerConfig{Name: mainListener}
+	result := []*listenerConfig{main}
+	for _, lc := range getAppConfig().Listeners {
+		if lc == nil || lc.Name == "" {
+			continue
+		}
+		if lc.Name == mainListener {
+			*main = *lc
+			continue
+		}
+		result = append(result, lc)
+	}
+	main.Addr = xattr.AppMain().MustGetListen(mainListener)
+	return result
+}
+
+var ctxKeyListener = xctx.NewKey()
+
+func contextWithListener(ctx context.Context, lc *listenerConfig) context.Context {
+	return context.WithValue(ctx, ctxKeyListener, lc)
+}
+
+var defaultListener = &listenerConfig{Name: mainListener}
+
+// listenerFromContext 返回请求所属的监听配置，总是不为 nil
+func listenerFromContext(ctx context.Context) *listenerConfig {
+	if lc, ok := ctx.Value(ctxKeyListener).(*listenerConfig); ok {
+		return lc
+	}
+	return defaultListener
+}
+
+// getHedgeWithRequest 对冲请求数，客户端可通过 HTTP Header [X-Man-Hedge] 或者代理用户名指定
+func getHedgeWithRequest(req *http.Request, user *User) int {
+	num := listenerFromContext(req.Context()).Hedge
+	if user != nil && user.Options.Hedge > 0 {
+		num = user.Options.Hedge
+	}
+	if str := req.Header.Get("X-Man-Hedge"); str != "" {
+		num, _ = strconv.Atoi(str)
+	}
+	return min(num, getHedgeMax())
+}
@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xlog"
+	"github.com/xanygo/anygo/xvalidator"
+)
+
+// 缓存的最多证书数量，超过后清空重新生成
+const mitmCertCacheSize = 4096
+
+func getMITMCAFiles() (certFile string, keyFile string) {
+	certFile = xattr.GetDefault[string]("MITMCACert", "mitm_ca.crt")
+	keyFile = xattr.GetDefault[string]("MITMCAKey", "mitm_ca.key")
+	if !filepath.IsAbs(certFile) {
+		certFile = filepath.Join(xattr.ConfDir(), certFile)
+	}
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(xattr.ConfDir(), keyFile)
+	}
+	return certFile, keyFile
+}
+
+// mitmCA 用于 HTTPS 解密的根证书，以及由其签发的网站证书
+type mitmCA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+
+	// 所有网站证书共用一个私钥，避免每次签发时生成私钥的开销
+	leafKey crypto.Signer
+
+	mux    sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+var mitmCAStore = &mitmCALoader{}
+
+// mitmCALoader 首次使用时读取或者生成根证书，失败时下次使用会重试
+type mitmCALoader struct {
+	mux sync.Mutex
+	ca  *mitmCA
+}
+
+func (l *mitmCALoader) Load() (*mitmCA, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.ca != nil {
+		return l.ca, nil
+	}
+	ca, err := loadOrCreateMITMCA()
+	if err != nil {
+		return nil, fmt.Errorf("load MITM CA failed: %w", err)
+	}
+	l.ca = ca
+	return ca, nil
+}
+
+// isMITMConfigured 是否有用户或者路由规则开启了 HTTPS 解密，未开启时不会生成根证书
+func isMITMConfigured() bool {
+	for _, u := range usersStore.Load() {
+		if u.MITM {
+			return true
+		}
+	}
+	return slices.ContainsFunc(routes.All(), func(r *routeRule) bool {
+		return r.MITM
+	})
+}
+
+// loadOrCreateMITMCA 读取已有的根证书，不存在时生成新的并保存
+func loadOrCreateMITMCA() (*mitmCA, error) {
+	certFile, keyFile := getMITMCAFiles()
+	certPEM, err1 := os.ReadFile(certFile)
+	keyPEM, err2 := os.ReadFile(keyFile)
+	if err1 != nil || err2 != nil {
+		if !errors.Is(err1, os.ErrNotExist) || !errors.Is(err2, os.ErrNotExist) {
+			return nil, fmt.Errorf("read %s or %s failed: %w", certFile, keyFile, errors.Join(err1, err2))
+		}
+		var err error
+		certPEM, keyPEM, err = createMITMCA()
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return nil, err
+		}
+		log.Println("create MITM CA success:", certFile)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA private key %T", pair.PrivateKey)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca := &mitmCA{
+		cert:    pair.Leaf,
+		key:     key,
+		certPEM: certPEM,
+		leafKey: leafKey,
+		leaves:  make(map[string]*tls.Certificate),
+	}
+	if ca.cert == nil {
+		if ca.cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+func createMITMCA() (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: randSerialNumber(),
+		Subject: pkix.Name{
+			CommonName:   "proxy-manager MITM CA",
+			Organization: []string{"proxy-manager"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func randSerialNumber() *big.Int {
+	num, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return num
+}
+
+// getCertificate 返回 host 的证书，有缓存
+func (ca *mitmCA) getCertificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ca.mux.Lock()
+	defer ca.mux.Unlock()
+	if cert, ok := ca.leaves[host]; ok && time.Until(cert.Leaf.NotAfter) > 24*time.Hour {
+		return cert, nil
+	}
+	cert, err := ca.createLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ca.leaves) >= mitmCertCacheSize {
+		clear(ca.leaves)
+	}
+	ca.leaves[host] = cert
+	return cert, nil
+}
+
+func (ca *mitmCA) createLeaf(host string) (*tls.Certificate, error) {
+	now := time.Now()
+	notAfter := now.AddDate(1, 0, 0)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randSerialNumber(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		tmpl.IPAddresses = []net.IP{addr.AsSlice()}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, ca.leafKey.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// isMITMEnabled 是否解密 HTTPS 请求：用户配置了 MITM，或者匹配的路由规则配置了 MITM
+func isMITMEnabled(ctx context.Context, user *User) bool {
+	if u := getUser(user.Name); u != nil && u.MITM {
+		return true
+	}
+	if r := routeRuleFromContext(ctx); r != nil && r.MITM {
+		return true
+	}
+	return false
+}
+
+// bufferedConn 读取时先读取 bufio.Reader 中已预读的数据
+type bufferedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+// oneConnListener 只返回一个连接的 net.Listener，连接关闭后 Accept 返回 io.EOF
+type oneConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newOneConnListener(conn net.Conn) *oneConnListener {
+	l := &oneConnListener{closed: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: conn, onClose: l.Close}
+	return l
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *oneConnListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func() error
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.onClose()
+	})
+	return err
+}
+
+// handleMITM 解密客户端的 HTTPS 请求，并使用 forwardRequest 转发。
+// 若客户端发送的不是 TLS 请求，则退化为普通的隧道
+func (hc *reply) handleMITM(ctx context.Context, conn net.Conn, req *http.Request, user *User, filter string) {
+	_, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "send Connection Established"))
+		return
+	}
+
+	tt := getTunnelTimeouts(ctx, user)
+	rd := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(tt.Connect))
+	head, err := rd.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "mitm peek"))
+		return
+	}
+	cConn := &bufferedConn{Conn: conn, rd: rd}
+	host, _, _ := parseHostPort(req.RequestURI)
+
+	// 0x16: TLS 握手消息，根证书不可用时也退化为普通的隧道
+	var ca *mitmCA
+	skip := "skip, not tls"
+	if head[0] == 0x16 {
+		ca, err = mitmCAStore.Load()
+		if err != nil {
+			skip = "skip, CA unavailable"
+			xlog.AddAttr(ctx, xlog.ErrorAttr("MITMError", err))
+		}
+	}
+	if ca == nil {
+		xlog.AddAttr(ctx, xlog.String("MITM", skip))
+		release, err := waitDomainLimit(ctx, host)
+		if err != nil {
+			// 已返回了 200 Connection Established，只能关闭连接
+			xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "waitDomainLimit"))
+			return
+		}
+		defer release()
+		one, tier, sConn, err := hc.getProxyServerConn(ctx, filter, getRetryWithRequest(req, user)+1, getHedgeWithRequest(req, user), req.RequestURI, tt.Connect)
+		if err != nil {
+			xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "getProxyServerConn"))
+			return
+		}
+		tk := newTrafficKey(ctx, user.Name, one, host)
+		tk.Tier = tier.Name
+		hc.pipe(ctx, cConn, one, sConn, tt, tk)
+		return
+	}
+
+	tlsConn := tls.Server(cConn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return ca.getCertificate(hello.ServerName)
+			}
+			return ca.getCertificate(host)
+		},
+	})
+	hsCtx, cancel := context.WithTimeout(ctx, tt.Connect)
+	err = tlsConn.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "mitm handshake"))
+		return
+	}
+	xlog.AddAttr(ctx, xlog.String("MITM", "on"))
+
+	handler := &mitmHandler{
+		relay:  hc,
+		target: req.RequestURI,
+		user:   user,
+		filter: filter,
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: tt.Connect,
+		IdleTimeout:       tt.Idle,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	ln := newOneConnListener(tlsConn)
+
+	var closeReason atomic.Pointer[string]
+	closeWith := func(reason string) {
+		closeReason.CompareAndSwap(nil, &reason)
+		ln.conn.Close()
+	}
+	var lifetime <-chan time.Time
+	if tt.MaxLifetime > 0 {
+		timer := time.NewTimer(tt.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeWith(tunnelCloseCanceled)
+		case <-lifetime:
+			closeWith(tunnelCloseMaxLifetime)
+		case <-done:
+		}
+	}()
+	srv.Serve(ln)
+	close(done)
+
+	// 空闲超时由 http.Server 关闭连接，和客户端关闭不做区分
+	reason := tunnelCloseClient
+	if p := closeReason.Load(); p != nil {
+		reason = *p
+	}
+	xlog.AddAttr(ctx, xlog.Int64("MITMRequests", handler.total.Load()), xlog.String("CloseReason", reason))
+}
+
+// mitmHandler 处理解密后的 HTTPS 请求
+type mitmHandler struct {
+	relay  *reply
+	target string // CONNECT 的目标地址，如 example.com:443
+	user   *User
+	filter string
+	total  atomic.Int64
+}
+
+func (mh *mitmHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mh.total.Add(1)
+	ctx := req.Context()
+
+	// 默认端口不用写在 URL 中，如 example.com:443 -> example.com
+	authority := strings.TrimSuffix(mh.target, ":443")
+	urlStr := "https://" + authority + req.URL.RequestURI()
+	if err := xvalidator.IsHTTPURL(urlStr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	body, err := newReplayBody(w, req)
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	rr, err := http.NewRequestWithContext(ctx, req.Method, urlStr, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	rr.ContentLength = req.ContentLength
+	if req.Host != "" {
+		rr.Host = req.Host
+	}
+	for k, v := range req.Header {
+		if isProxyHeader(k) {
+			continue
+		}
+		for _, vv := range v {
+			rr.Header.Add(k, vv)
+		}
+	}
+
+	param := forwardParam{
+		Request:  rr,
+		Body:     body,
+		Username: mh.user.Name,
+		Filter:   mh.filter,
+		Attempt:  getRetryWithRequest(req, mh.user) + 1,
+		Hedge:    getHedgeWithRequest(req, mh.user),
+		Format:   getFormatWithRequest(req, mh.user),
+	}
+	mh.relay.forwardRequest(ctx, w, param)
+}
@@ -3,10 +3,10 @@ package internal
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"math/rand/v2"
 	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,7 +14,6 @@ import (
 	"github.com/xanygo/anygo/ds/xctx"
 	"github.com/xanygo/anygo/ds/xslice"
 	"github.com/xanygo/anygo/ds/xsync"
-	"github.com/xanygo/anygo/safely"
 	"github.com/xanygo/anygo/xattr"
 	"github.com/xanygo/anygo/xerror"
 	"github.com/xanygo/anygo/xlog"
@@ -29,7 +28,7 @@ func dynCfgPath() string {
 
 // ProxyPool 代理池
 type ProxyPool struct {
-	checkerJobs chan *proxyEntry
+	checker *checkRunner
 
 	active *ProxyList // 活跃可用的
 	all    *ProxyList // 所有的
@@ -45,21 +44,23 @@ var pool *ProxyPool
 // loadPool 从配置文件中加载代理池
 func loadPool() *ProxyPool {
 	p := &ProxyPool{
-		checkerJobs: make(chan *proxyEntry, 8),
-		all:         newProxyList(nil),
-		active:      newProxyList(nil),
-		primary:     newProxyList(nil),
-		dyn:         newProxyList(nil),
+		all:     newProxyList(nil),
+		active:  newProxyList(nil),
+		primary: newProxyList(nil),
+		dyn:     newProxyList(nil),
 	}
 
 	p.loadProxies()
+	p.loadState()
 
-	p.startCheckWorkers()
+	p.checker = newCheckRunner(loadCheckerConfig(), p.testProxyAddActive)
 
-	SetInterval(p.startCheckProducer, getCheckInterval())
+	SetInterval(p.startCheckProducer, checkScheduleTick)
 	go p.startCheckProducer()
 
 	SetInterval(p.trySaveToFile, 2*time.Second)
+	SetInterval(p.removeExpired, time.Minute)
+	SetInterval(p.saveState, time.Minute)
 
 	return p
 }
@@ -111,51 +112,40 @@ func (p *ProxyPool) getOneProxyActive(ctx context.Context, filter string) (*prox
 	if val, ok := ctx.Value(ctxKeyUseProxy).(*proxyEntry); ok {
 		return val, nil
 	}
-	return p.active.FilterOne(filter)
-}
-
-var producerRunning atomic.Bool
-
-func (p *ProxyPool) startCheckProducer() {
-	if !producerRunning.CompareAndSwap(false, true) {
-		xlog.Warn(context.Background(), "CheckProducer already running, skipped")
-		return
+	if ss := sessionFromContext(ctx); ss != nil {
+		return ss.pick(p.active, filter)
 	}
-	defer producerRunning.Store(false)
-
-	start := time.Now()
-	items := p.all.All()
-
-	xlog.Info(context.Background(), "CheckProducer starting...", xlog.Int("TotalJobs", len(items)))
-
-	var isCanceled bool
-
-	for _, one := range items {
-		if time.Now().Before(silentDeadline.Load()) {
-			isCanceled = true
-			break
-		}
-		p.checkerJobs <- one
+	list, err := p.active.Filter(filter)
+	if err != nil {
+		return nil, err
 	}
-	cost := time.Since(start)
-	xlog.Info(context.Background(), "CheckProducer done",
-		xlog.Int("TotalJobs", len(items)),
-		xlog.DurationMS("Cost", cost),
-		xlog.Bool("IsCanceled", isCanceled),
-		xlog.Time("Start", start),
-	)
+	// 避开被目标域名封禁了的
+	list = reputation.avoidBanned(targetDomainFromContext(ctx), list)
+	return strategyFromContext(ctx).Pick(ctx, list), nil
 }
 
-func (p *ProxyPool) startCheckWorkers() {
-	for i := 0; i < 8; i++ {
-		go safely.Run(p.checkWorker)
+// getProxiesActive 获取最多 n 个不同的可用代理，用于对冲请求
+// 指定了代理或者会话时，只返回一个
+func (p *ProxyPool) getProxiesActive(ctx context.Context, filter string, n int) ([]*proxyEntry, error) {
+	if val, ok := ctx.Value(ctxKeyUseProxy).(*proxyEntry); ok {
+		return []*proxyEntry{val}, nil
 	}
-}
-
-func (p *ProxyPool) checkWorker() {
-	for one := range p.checkerJobs {
-		p.testProxyAddActive(one)
+	if ss := sessionFromContext(ctx); ss != nil {
+		one, err := ss.pick(p.active, filter)
+		if err != nil {
+			return nil, err
+		}
+		return []*proxyEntry{one}, nil
+	}
+	list, err := p.active.Filter(filter)
+	if err != nil {
+		return nil, err
 	}
+	list = slices.Clone(reputation.avoidBanned(targetDomainFromContext(ctx), list))
+	rand.Shuffle(len(list), func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	})
+	return list[:min(n, len(list))], nil
 }
 
 // 尝试保存文件
@@ -181,12 +171,17 @@ func (p *ProxyPool) trySaveToFile() {
 }
 
 // testProxyAddActive 测试一个代理是否可用 若可用则加入代理池否则删除
-func (p *ProxyPool) testProxyAddActive(one *proxyEntry) {
-	if p.checkProxyEntry(one) {
-		p.active.Add(one)
-	} else {
-		p.active.Remove(one)
+func (p *ProxyPool) testProxyAddActive(one *proxyEntry) bool {
+	ok := p.checkProxyEntry(one)
+	if p.all.Get(one.Base.Proxy) == nil {
+		// 检查期间已被删除
+		return ok
 	}
+	one.State.Restored.Store(false)
+	recordCheckResult(one, ok)
+	p.applyCheckResult(one, ok)
+	scheduleNextCheck(one)
+	return ok
 }
 
 var lastChecked xsync.Value[string]
@@ -196,55 +191,52 @@ func (p *ProxyPool) checkProxyEntry(proxy *proxyEntry) bool {
 		return false
 	}
 	start := time.Now()
-	ctx, cancel := context.WithTimeout(context.Background(), getProxyTimeout())
+	ctx, cancel := context.WithTimeout(context.Background(), p.checker.Timeout())
 	defer cancel()
 	ctx = xlog.NewContext(ctx)
 
 	xlog.AddAttr(ctx, xlog.String("Proxy", proxy.Base.Proxy))
 
-	checkURL := getProbeURL()
-	resp, err := httpGetByProxyEntry(ctx, checkURL, proxy)
+	results := runProbes(ctx, proxy, probesFor(proxy))
+	ps := summarizeProbes(results, getProbeQuorum(len(results)))
 	{
 		cost := time.Since(start)
 		proxy.State.LastCheckUsed.Store(cost)
 		proxy.State.LastCheck.Store(start)
 		proxy.State.CheckTimes.Add(1)
 	}
-	if err != nil {
-		proxy.State.LastCheckStatus.Store(int64(255))
-		proxy.State.LastCheckMsg.Store(err.Error())
-		xlog.Warn(ctx, "checkProxy failed", xlog.ErrorAttr("error", err))
+	proxy.State.LastCheckStatus.Store(int64(ps.Status))
+	proxy.State.LastCheckMsg.Store(ps.Msg)
+	{
+		he := historyEntry{Source: historyCheck, Time: start, OK: ps.OK(), Status: ps.Status, Latency: ps.Latency, Error: ps.Msg}
+		if !he.OK {
+			he.Latency = time.Since(start)
+		}
+		proxy.State.History.Add(he)
+	}
+	xlog.AddAttr(ctx, xlog.Int("ProbePassed", ps.Passed), xlog.Int("ProbeQuorum", ps.Quorum))
 
-		lastChecked.Store(fmt.Sprintf("%s: %s >err: %s", time.Now().String(), proxy.Base.URL.Hostname(), err.Error()))
+	if !ps.OK() {
+		xlog.Warn(ctx, "checkProxy failed", xlog.String("error", ps.Msg))
 
-		if pool.dyn.Remove(proxy) {
-			pool.all.Remove(proxy)
-		}
+		lastChecked.Store(fmt.Sprintf("%s: %s >err: %s", time.Now().String(), proxy.Base.URL.Hostname(), ps.Msg))
 		return false
 	}
-	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
-
-	proxy.State.LastCheckStatus.Store(int64(resp.StatusCode))
-	proxy.State.LastCheckMsg.Store("")
 
-	lastChecked.Store(fmt.Sprintf("%s: %s >status: %s", time.Now().String(), proxy.Base.URL.Hostname(), resp.Status))
+	lastChecked.Store(fmt.Sprintf("%s: %s >passed: %d/%d", time.Now().String(), proxy.Base.URL.Hostname(), ps.Passed, len(results)))
 
-	switch resp.StatusCode {
-	case http.StatusOK, http.StatusNoContent:
-		proxy.State.LastCheckOk.Store(start)
-		xlog.Info(ctx, "checkProxy success")
-		return true
+	proxy.State.LastCheckOk.Store(start)
+	proxy.State.Latency.Observe(ps.Latency)
+	if ps.ExitIP != "" {
+		setExitIP(proxy, ps.ExitIP)
 	}
-
-	xlog.Warn(ctx, "checkProxy failed", xlog.Int("StatusCode", resp.StatusCode))
-	return false
+	checkAnonymity(ctx, proxy)
+	xlog.Info(ctx, "checkProxy success", xlog.String("ExitIP", proxy.State.ExitIP.Load()))
+	return true
 }
 
 var dynCleanRunning atomic.Bool
 
-var dynCleanLimiter = make(chan struct{}, 8)
-
 // DynClean 清理 dyn 里无无效的配置
 func (p *ProxyPool) DynClean(limit int, timeout int) any {
 	dynCleanRunning.Store(true)
@@ -257,22 +249,25 @@ func (p *ProxyPool) DynClean(limit int, timeout int) any {
 	var deletedTotal atomic.Int32
 	var checked atomic.Int32
 
+	// 并发数和检查的 worker 数相同
+	workers := p.checker.Config().Workers
+	limiter := make(chan struct{}, workers)
+
 	// 分批检查
 	check := func(list []*proxyEntry) {
 		var deleted atomic.Int32
 		var wg xsync.WaitGroup
 		for _, proxy := range list {
 			wg.Go(func() {
-				dynCleanLimiter <- struct{}{}
+				limiter <- struct{}{}
 				defer func() {
-					<-dynCleanLimiter
+					<-limiter
 				}()
 				start := time.Now()
 				err := proxy.TestByDial(ctx, timeout)
 				cost := time.Since(start)
 				if err != nil {
-					p.dyn.Remove(proxy)
-					p.all.Remove(proxy)
+					p.removeProxy(proxy, "DynClean: "+err.Error())
 
 					deleted.Add(1)
 					deletedTotal.Add(1)
@@ -301,7 +296,7 @@ func (p *ProxyPool) DynClean(limit int, timeout int) any {
 
 	start := time.Now()
 
-	itemsChunk := xslice.Chunk(p.dyn.All(), 16)
+	itemsChunk := xslice.Chunk(p.dyn.All(), max(16, workers))
 	for _, pps := range itemsChunk {
 		if time.Now().Before(silentDeadline.Load()) {
 			break
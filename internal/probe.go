@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+)
+
+// probeConfig 检查代理是否可用的探测，配置在 app.yml 的 Probes 中，所有配置了的条件都需要满足
+type probeConfig struct {
+	Name        string   `yaml:"Name"`
+	URL         string   `yaml:"URL"`         // 地址，{rand} 会被替换为随机数，为空时使用 ProbeURL
+	Method      string   `yaml:"Method"`      // 请求方法，默认 GET
+	Status      []int    `yaml:"Status"`      // 期望的状态码，默认 200 和 204
+	Body        string   `yaml:"Body"`        // 响应 Body 需要匹配的正则
+	BodyEqual   string   `yaml:"BodyEqual"`   // 响应 Body（去掉首尾的空白）需要等于的值
+	MaxLatency  int      `yaml:"MaxLatency"`  // 最大耗时（读取完 Body），单位毫秒，0 为不限制
+	MaxBodySize int64    `yaml:"MaxBodySize"` // 响应 Body 的最大长度，超过时不通过，默认 64KB
+	Tags        []string `yaml:"Tags"`        // 只用于有这些标签之一的代理，为空时用于所有的代理
+}
+
+type probe struct {
+	probeConfig
+	body *regexp.Regexp
+}
+
+// probeMaxBodySize 默认的响应 Body 的最大长度
+const probeMaxBodySize = 64 * 1024
+
+// 检查失败时 LastCheckStatus 的值
+const (
+	checkStatusError  = 255 // 请求失败
+	checkStatusAssert = 254 // 返回了 200 或 204，但 Body 或耗时不符合要求
+)
+
+func newProbe(index int, cfg *probeConfig) (*probe, error) {
+	p := &probe{probeConfig: *cfg}
+	if p.Name == "" {
+		p.Name = "probe#" + strconv.Itoa(index+1)
+	}
+	p.Method = strings.ToUpper(strings.TrimSpace(p.Method))
+	if p.Method == "" {
+		p.Method = http.MethodGet
+	}
+	if len(p.Status) == 0 {
+		p.Status = []int{http.StatusOK, http.StatusNoContent}
+	}
+	if p.MaxBodySize <= 0 {
+		p.MaxBodySize = probeMaxBodySize
+	}
+	if p.Body != "" {
+		reg, err := regexp.Compile(p.Body)
+		if err != nil {
+			return nil, fmt.Errorf("probe %q: invalid Body %q: %w", p.Name, p.Body, err)
+		}
+		p.body = reg
+	}
+	if p.URL != "" {
+		if _, err := http.NewRequest(p.Method, p.URL, nil); err != nil {
+			return nil, fmt.Errorf("probe %q: invalid URL %q: %w", p.Name, p.URL, err)
+		}
+	}
+	return p, nil
+}
+
+// defaultProbe 没有配置 Probes，或者没有适用于代理的探测时使用：请求 ProbeURL，返回 200 或 204 即可
+var defaultProbe, _ = newProbe(0, &probeConfig{Name: "default"})
+
+var probes []*probe
+
+func loadProbes() []*probe {
+	var result []*probe
+	for i, cfg := range getAppConfig().Probes {
+		p, err := newProbe(i, cfg)
+		if err != nil {
+			log.Fatalln("load Probes failed:", err)
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// probesFor 适用于代理的探测
+func probesFor(proxy *proxyEntry) []*probe {
+	tags := proxy.Tags()
+	var result []*probe
+	for _, p := range probes {
+		if len(p.Tags) == 0 || slices.ContainsFunc(p.Tags, func(tag string) bool {
+			return slices.Contains(tags, tag)
+		}) {
+			result = append(result, p)
+		}
+	}
+	if len(result) == 0 {
+		return []*probe{defaultProbe}
+	}
+	return result
+}
+
+// getProbeQuorum 代理可用需要通过的探测数，app.yml 中的 ProbeQuorum，默认为全部
+func getProbeQuorum(total int) int {
+	num := xattr.GetDefault[int]("ProbeQuorum", 0)
+	if num <= 0 || num > total {
+		return total
+	}
+	return num
+}
+
+func (p *probe) url() string {
+	if p.URL == "" {
+		return getProbeURL()
+	}
+	return strings.ReplaceAll(p.URL, "{rand}", strconv.Itoa(rand.Int()))
+}
+
+// probeResult 一次探测的结果
+type probeResult struct {
+	Name    string
+	OK      bool
+	Status  int // 响应的状态码，请求失败时为 checkStatusError
+	Latency time.Duration
+	Msg     string // 失败的原因
+	Body    []byte `json:"-"`
+}
+
+// run 通过代理执行一次探测
+func (p *probe) run(ctx context.Context, proxy *proxyEntry) probeResult {
+	ret := probeResult{Name: p.Name, Status: checkStatusError}
+	start := time.Now()
+	resp, err := httpRequestByProxyURL(ctx, p.Method, p.url(), proxy.Base.URL)
+	if err != nil {
+		ret.Latency = time.Since(start)
+		ret.Msg = err.Error()
+		return ret
+	}
+	defer resp.Body.Close()
+	ret.Status = resp.StatusCode
+	ret.Body, err = io.ReadAll(io.LimitReader(resp.Body, p.MaxBodySize+1))
+	ret.Latency = time.Since(start)
+	switch {
+	case err != nil:
+		ret.Msg = "read body failed: " + err.Error()
+	case !slices.Contains(p.Status, resp.StatusCode):
+		ret.Msg = "unexpected status " + strconv.Itoa(resp.StatusCode)
+	case int64(len(ret.Body)) > p.MaxBodySize:
+		ret.Msg = "body too large"
+	case p.body != nil && !p.body.Match(ret.Body):
+		ret.Msg = "body not match"
+	case p.BodyEqual != "" && strings.TrimSpace(string(ret.Body)) != p.BodyEqual:
+		ret.Msg = "body not equal"
+	case p.MaxLatency > 0 && ret.Latency > time.Duration(p.MaxLatency)*time.Millisecond:
+		ret.Msg = "too slow: " + ret.Latency.Round(time.Millisecond).String()
+	default:
+		ret.OK = true
+	}
+	return ret
+}
+
+// runProbes 同时执行多个探测，结果和 list 的顺序一致
+func runProbes(ctx context.Context, proxy *proxyEntry, list []*probe) []probeResult {
+	results := make([]probeResult, len(list))
+	var wg sync.WaitGroup
+	for i, p := range list {
+		wg.Go(func() {
+			results[i] = p.run(ctx, proxy)
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// probeSummary 检查结果的汇总
+type probeSummary struct {
+	Passed  int
+	Quorum  int
+	Status  int           // 用于 LastCheckStatus，通过时为 200
+	Latency time.Duration // 通过的探测的平均耗时
+	Msg     string        // 未通过的探测及原因
+	ExitIP  string        // 从通过的探测的 Body 中解析的出口 IP，没有时为空，不使用代理地址
+}
+
+func (ps probeSummary) OK() bool {
+	return ps.Passed >= ps.Quorum
+}
+
+// summarizeProbes 汇总探测结果，quorum 为需要通过的探测数，见 getProbeQuorum
+func summarizeProbes(results []probeResult, quorum int) probeSummary {
+	ps := probeSummary{Quorum: quorum}
+	var failed []string
+	for _, ret := range results {
+		if !ret.OK {
+			failed = append(failed, ret.Name+": "+ret.Msg)
+			if ps.Status == 0 {
+				ps.Status = ret.Status
+			}
+			continue
+		}
+		ps.Passed++
+		ps.Latency += ret.Latency
+		if ps.ExitIP == "" {
+			ps.ExitIP = parseExitIPBody(ret.Body)
+		}
+	}
+	if ps.Passed > 0 {
+		ps.Latency /= time.Duration(ps.Passed)
+	}
+	ps.Msg = strings.Join(failed, "; ")
+	switch {
+	case ps.OK():
+		ps.Status = http.StatusOK
+	case ps.Status == http.StatusOK || ps.Status == http.StatusNoContent:
+		ps.Status = checkStatusAssert
+	}
+	return ps
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewProbe(t *testing.T) {
+	p, err := newProbe(1, &probeConfig{Method: " post "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "probe#2" || p.Method != http.MethodPost || len(p.Status) != 2 || p.MaxBodySize != probeMaxBodySize {
+		t.Fatalf("got %+v", p.probeConfig)
+	}
+	for _, cfg := range []*probeConfig{
+		{Body: "("},
+		{URL: "http://[::1"},
+	} {
+		if _, err := newProbe(0, cfg); err == nil {
+			t.Errorf("newProbe(%+v) expect error", cfg)
+		}
+	}
+}
+
+func TestProbeRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ip":
+			w.Write([]byte(" 1.2.3.4\n"))
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 100)))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		cfg     probeConfig
+		wantMsg string // 为空时应该通过
+	}{
+		{cfg: probeConfig{URL: ts.URL + "/ip?r={rand}"}},
+		{cfg: probeConfig{URL: ts.URL + "/ip", Body: `^\s*\d+\.\d+\.\d+\.\d+\s*$`, BodyEqual: "1.2.3.4"}},
+		{cfg: probeConfig{URL: ts.URL + "/ip", Body: "^abc"}, wantMsg: "body not match"},
+		{cfg: probeConfig{URL: ts.URL + "/ip", BodyEqual: "5.6.7.8"}, wantMsg: "body not equal"},
+		{cfg: probeConfig{URL: ts.URL + "/404"}, wantMsg: "unexpected status 404"},
+		{cfg: probeConfig{URL: ts.URL + "/404", Status: []int{404}}},
+		{cfg: probeConfig{URL: ts.URL + "/large", MaxBodySize: 50}, wantMsg: "body too large"},
+		{cfg: probeConfig{URL: ts.URL + "/slow", MaxLatency: 10}, wantMsg: "too slow"},
+	}
+	for _, tt := range tests {
+		p, err := newProbe(0, &tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := p.run(context.Background(), directEntry)
+		if ret.OK != (tt.wantMsg == "") || !strings.HasPrefix(ret.Msg, tt.wantMsg) {
+			t.Errorf("%s: OK=%v, Msg=%q, want %q", tt.cfg.URL, ret.OK, ret.Msg, tt.wantMsg)
+		}
+	}
+}
+
+func TestSummarizeProbes(t *testing.T) {
+	ok := func(name string, latency time.Duration, body string) probeResult {
+		return probeResult{Name: name, OK: true, Status: http.StatusOK, Latency: latency, Body: []byte(body)}
+	}
+	fail := func(name string, status int, msg string) probeResult {
+		return probeResult{Name: name, Status: status, Msg: msg}
+	}
+	tests := []struct {
+		name        string
+		results     []probeResult
+		quorum      int
+		wantOK      bool
+		wantStatus  int
+		wantLatency time.Duration
+		wantMsg     string
+		wantExitIP  string
+	}{
+		{name: "all passed", results: []probeResult{ok("a", 100*time.Millisecond, "1.2.3.4"), ok("b", 300*time.Millisecond, "")},
+			quorum: 2, wantOK: true, wantStatus: http.StatusOK, wantLatency: 200 * time.Millisecond, wantExitIP: "1.2.3.4"},
+		{name: "quorum reached", results: []probeResult{fail("a", checkStatusError, "timeout"), ok("b", time.Second, `{"origin":"5.6.7.8, 1.1.1.1"}`)},
+			quorum: 1, wantOK: true, wantStatus: http.StatusOK, wantLatency: time.Second, wantMsg: "a: timeout", wantExitIP: "5.6.7.8"},
+		{name: "request failed", results: []probeResult{fail("a", checkStatusError, "timeout"), ok("b", time.Second, "")},
+			quorum: 2, wantStatus: checkStatusError, wantLatency: time.Second, wantMsg: "a: timeout"},
+		{name: "assert failed", results: []probeResult{fail("a", http.StatusOK, "body not match"), fail("b", http.StatusForbidden, "unexpected status 403")},
+			quorum: 1, wantStatus: checkStatusAssert, wantMsg: "a: body not match; b: unexpected status 403"},
+		// Body 中没有 IP 时不使用代理的地址作为出口 IP
+		{name: "no exit ip", results: []probeResult{ok("a", time.Second, "ok")},
+			quorum: 1, wantOK: true, wantStatus: http.StatusOK, wantLatency: time.Second},
+		{name: "exit ip only from passed", results: []probeResult{{Name: "a", Status: http.StatusOK, Msg: "too slow", Body: []byte("9.9.9.9")}, ok("b", time.Second, "ok")},
+			quorum: 1, wantOK: true, wantStatus: http.StatusOK, wantLatency: time.Second, wantMsg: "a: too slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := summarizeProbes(tt.results, tt.quorum)
+			if ps.OK() != tt.wantOK || ps.Status != tt.wantStatus || ps.Latency != tt.wantLatency ||
+				ps.Msg != tt.wantMsg || ps.ExitIP != tt.wantExitIP {
+				t.Fatalf("got %+v, OK()=%v", ps, ps.OK())
+			}
+		})
+	}
+
+	// 没有配置 ProbeQuorum 时需要全部通过
+	if got := getProbeQuorum(3); got != 3 {
+		t.Fatalf("getProbeQuorum(3)=%d", got)
+	}
+}
@@ -5,13 +5,14 @@ import (
 	"errors"
 	"io/fs"
 	"log"
-	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -85,9 +86,30 @@ type proxyState struct {
 	LastCheckUsed   xsync.TimeDuration  // 最后检查耗时
 	CheckTimes      atomic.Int64        // 检查次数
 	LastCheckMsg    xsync.Value[string] // 最后检查的消息。
+	NextCheck       xsync.TimeStamp     // 下次检查的时间，为空时尽快检查
+	CheckFails      atomic.Int64        // 连续检查失败的次数，用于退避
+	Lifecycle       xsync.Value[string] // 生命周期状态，见 stateNew 等
+	LifecycleSince  xsync.TimeStamp     // 进入当前状态的时间
+	Restored        atomic.Bool         // 从快照恢复为 active，还未重新检查
 
 	UsedTotal   atomic.Int64 // 被使用的次数
 	UsedSuccess atomic.Int64 // 使用正常的次数
+
+	HedgeWin  atomic.Int64 // 对冲请求中胜出的次数
+	HedgeLoss atomic.Int64 // 对冲请求中落后或失败的次数
+
+	ExitIP   xsync.Value[string]   // 出口 IP，由检查时获取
+	Geo      xsync.Value[geoInfo]  // 出口 IP 的国家和 ASN
+	AutoTags xsync.Value[[]string] // 自动添加的标签，如国家、ASN、匿名级别，不会保存到配置文件
+
+	Anonymity xsync.Value[string] // 匿名级别，配置了 EchoURL 时由检查获取
+
+	Breaker circuitBreaker // 熔断器，根据实际使用的结果判断是否可用
+
+	InFlight atomic.Int64    // 进行中的请求和隧道数
+	LastUsed xsync.TimeStamp // 最后一次被使用的时间
+	Latency  ewmaDuration    // 检查和转发耗时的 EWMA
+	History  proxyHistory    // 最近的检查和转发结果
 }
 
 func (ps *proxyState) UsedFailed() int64 {
@@ -128,6 +150,29 @@ func (p *proxyEntry) IsOk() bool {
 	return p.State.IsStatusOk()
 }
 
+// Tags 所有的标签，包括配置的和自动添加的
+func (p *proxyEntry) Tags() []string {
+	auto := p.State.AutoTags.Load()
+	if len(auto) == 0 {
+		return p.Base.Tags
+	}
+	return append(slices.Clone(p.Base.Tags), auto...)
+}
+
+// Traffic 代理的流量统计
+func (p *proxyEntry) Traffic() trafficItem {
+	return traffic.Get(trafficGroupProxy, p.Base.Proxy)
+}
+
+// updateAutoTags 根据出口 IP 的国家、ASN 和匿名级别更新自动添加的标签
+func updateAutoTags(p *proxyEntry) {
+	tags := p.State.Geo.Load().Tags()
+	if level := p.State.Anonymity.Load(); level != "" {
+		tags = append(tags, level)
+	}
+	p.State.AutoTags.Store(tags)
+}
+
 func (p *proxyEntry) GetUsedTotal() int64 {
 	return p.State.UsedTotal.Load()
 }
@@ -169,7 +214,6 @@ func newProxyList(items []*proxyBase) *ProxyList {
 type ProxyList struct {
 	all     *xslice.Sync[*proxyEntry]
 	list    *xmap.Sync[string, *proxyEntry]
-	nextID  atomic.Int64
 	changed xsync.TimeStamp // 保存首次修改后的时间
 }
 
@@ -200,6 +244,10 @@ func (pl *ProxyList) updateAll() {
 		all = append(all, proxy)
 		return true
 	})
+	// 保持稳定的顺序，以便于轮询
+	slices.SortFunc(all, func(a, b *proxyEntry) int {
+		return strings.Compare(a.Base.Proxy, b.Base.Proxy)
+	})
 	pl.all.Store(all)
 }
 
@@ -237,37 +285,50 @@ func (pl *ProxyList) MergeTo(to *ProxyList) {
 
 var errorNoProxy = errors.New("no active proxy")
 
-// FilterOne 筛选过滤出一个满足条件的,
+// Filter 筛选过滤出所有满足条件的，
 //
-//	filter 格式：tag1 & tag2,tag3,[ANY]   -> 三个条件，同时有 tag1 和 tag2 或者 有tag 3，或者 任意返回一个
-//	按照顺序依次返回
-func (pl *ProxyList) FilterOne(filter string) (*proxyEntry, error) {
+//	filter 格式：tag1 & tag2,tag3,[ANY]   -> 三个条件，同时有 tag1 和 tag2 或者 有tag 3，或者 任意一个
+//	也可以是表达式，见 parseFilterExpr
+func (pl *ProxyList) Filter(filter string) ([]*proxyEntry, error) {
+	fn, err := buildFilter(filter)
+	if err != nil {
+		return nil, err
+	}
 	allProxy := pl.all.Load()
 	if len(allProxy) == 0 {
 		return nil, errorNoProxy
 	}
-	fn, err := xslice.BuildTagFilter(filter, func(t *proxyEntry) []string {
-		return t.Base.Tags
-	}, 0)
-	if err != nil {
-		return nil, err
-	}
 	result := fn(allProxy)
 	if len(result) == 0 {
 		return nil, errorNoProxy
 	}
-	n := rand.IntN(len(result))
-	return result[n], nil
+	// 跳过已熔断的
+	if slices.ContainsFunc(result, proxyBroken) {
+		result = slices.DeleteFunc(slices.Clone(result), proxyBroken)
+		if len(result) == 0 {
+			return nil, errProxyBroken
+		}
+	}
+	// 跳过已达到并发数或请求频率限制的
+	if slices.ContainsFunc(result, proxySaturated) {
+		result = slices.DeleteFunc(slices.Clone(result), proxySaturated)
+		if len(result) == 0 {
+			return nil, errProxySaturated
+		}
+	}
+	if getCollapseExitIP() {
+		result = collapseByExitIP(result)
+	}
+	return result, nil
 }
 
-func (pl *ProxyList) Next() *proxyEntry {
-	allProxy := pl.all.Load()
-	if len(allProxy) == 0 {
+// nextOf 按照 id 计数依次返回 list 中的一个，list 为空时返回 nil
+func nextOf(id *atomic.Int64, list []*proxyEntry) *proxyEntry {
+	if len(list) == 0 {
 		return nil
 	}
-	nextID := pl.nextID.Add(1)
-	index := int(nextID) % len(allProxy)
-	return allProxy[index]
+	index := (id.Add(1) - 1) % int64(len(list))
+	return list[index]
 }
 
 func (pl *ProxyList) String() string {
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// userLimitConfig 用户的限速和流量配额，配置在 users.yml 中，0 为不限制
+type userLimitConfig struct {
+	RateLimit    int64 `yaml:"RateLimit"`    // 限速，单位 KB/s，上行和下行分别限制
+	DailyQuota   int64 `yaml:"DailyQuota"`   // 每天的流量配额（上行+下行），单位 MB
+	MonthlyQuota int64 `yaml:"MonthlyQuota"` // 每月的流量配额（上行+下行），单位 MB
+}
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaUsage 用户当前的流量和配额，用于展示
+type quotaUsage struct {
+	User         string
+	RateLimit    int64 // 字节/秒
+	DailyQuota   int64 // 字节
+	MonthlyQuota int64 // 字节
+	Traffic      trafficItem
+}
+
+// DailyPercent 今日流量占配额的百分比
+func (q quotaUsage) DailyPercent() int64 {
+	if q.DailyQuota <= 0 {
+		return 0
+	}
+	return q.Traffic.DayTotal() * 100 / q.DailyQuota
+}
+
+// MonthlyPercent 本月流量占配额的百分比
+func (q quotaUsage) MonthlyPercent() int64 {
+	if q.MonthlyQuota <= 0 {
+		return 0
+	}
+	return q.Traffic.MonthTotal() * 100 / q.MonthlyQuota
+}
+
+func getQuotaUsage(name string) quotaUsage {
+	q := quotaUsage{
+		User:    name,
+		Traffic: traffic.Get(trafficGroupUser, trafficUserKey(name)),
+	}
+	if u := getUser(name); u != nil {
+		q.RateLimit = u.RateLimit << 10
+		q.DailyQuota = u.DailyQuota << 20
+		q.MonthlyQuota = u.MonthlyQuota << 20
+	}
+	return q
+}
+
+// quotaError 超过了流量配额
+type quotaError struct {
+	Monthly bool  // 是否为月配额，否则为日配额
+	Quota   int64 // 单位 MB
+}
+
+func (e *quotaError) Error() string {
+	if e.Monthly {
+		return fmt.Sprintf("%s: monthly quota %d MB", errQuotaExceeded, e.Quota)
+	}
+	return fmt.Sprintf("%s: daily quota %d MB", errQuotaExceeded, e.Quota)
+}
+
+func (e *quotaError) Is(target error) bool {
+	return target == errQuotaExceeded
+}
+
+// resetAt 配额重置的时间
+func (e *quotaError) resetAt(now time.Time) time.Time {
+	if e.Monthly {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+// checkUserQuota 检查用户的流量是否已超过配额
+func checkUserQuota(name string) error {
+	u := getUser(name)
+	if u == nil || (u.DailyQuota <= 0 && u.MonthlyQuota <= 0) {
+		return nil
+	}
+	q := getQuotaUsage(name)
+	if q.MonthlyQuota > 0 && q.Traffic.MonthTotal() >= q.MonthlyQuota {
+		return &quotaError{Monthly: true, Quota: u.MonthlyQuota}
+	}
+	if q.DailyQuota > 0 && q.Traffic.DayTotal() >= q.DailyQuota {
+		return &quotaError{Quota: u.DailyQuota}
+	}
+	return nil
+}
+
+// writeQuotaExceeded 返回 429，Retry-After 为配额重置的时间
+func writeQuotaExceeded(w http.ResponseWriter, err error) {
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		now := time.Now()
+		w.Header().Set("Retry-After", strconv.Itoa(int(qe.resetAt(now).Sub(now).Seconds())))
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(err.Error()))
+}
+
+// tokenBucket 令牌桶限速，允许透支：一次消耗的令牌超过桶容量时，之后需要等待补足
+type tokenBucket struct {
+	rate float64 // 每秒产生的令牌数，即字节数
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// refill 补充令牌，需要在锁内调用
+func (tb *tokenBucket) refill() {
+	now := time.Now()
+	// 桶容量为 1 秒的令牌数，最少为 1 个
+	tb.tokens = min(tb.tokens+now.Sub(tb.last).Seconds()*tb.rate, max(tb.rate, 1))
+	tb.last = now
+}
+
+// reserve 消耗 n 个令牌，返回需要等待的时间
+func (tb *tokenBucket) reserve(n int) time.Duration {
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	tb.refill()
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// allow 令牌足够时消耗 n 个并返回 true，不足时不消耗，返回 false
+func (tb *tokenBucket) allow(n int) bool {
+	if tb == nil {
+		return true
+	}
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	tb.refill()
+	if tb.tokens < float64(n) {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
+
+// available 是否有足够的 n 个令牌，不消耗
+func (tb *tokenBucket) available(n int) bool {
+	if tb == nil {
+		return true
+	}
+	tb.mux.Lock()
+	defer tb.mux.Unlock()
+	tb.refill()
+	return tb.tokens >= float64(n)
+}
+
+// wait 消耗 n 个令牌，令牌不足时等待，done 关闭时返回 false
+func (tb *tokenBucket) wait(n int, done <-chan struct{}) bool {
+	if tb == nil || n <= 0 {
+		return true
+	}
+	d := tb.reserve(n)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// userLimiter 一个用户的限速，该用户的所有连接共用
+type userLimiter struct {
+	rate int64 // 字节/秒，配置变化时重新创建
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+var userLimiters = struct {
+	mux   sync.Mutex
+	items map[string]*userLimiter
+}{
+	items: make(map[string]*userLimiter),
+}
+
+// getUserLimiter 返回用户的限速器，没有配置限速时返回 nil
+func getUserLimiter(name string) *userLimiter {
+	var rateKB int64
+	if u := getUser(name); u != nil {
+		rateKB = u.RateLimit
+	}
+	return loadUserLimiter(name, rateKB)
+}
+
+// loadUserLimiter 返回限速为 rateKB（KB/s）的限速器，限速变化时重新创建，不限速时删除并返回 nil
+func loadUserLimiter(name string, rateKB int64) *userLimiter {
+	userLimiters.mux.Lock()
+	defer userLimiters.mux.Unlock()
+	if rateKB <= 0 {
+		delete(userLimiters.items, name)
+		return nil
+	}
+	rate := rateKB << 10
+	if ul, ok := userLimiters.items[name]; ok && ul.rate == rate {
+		return ul
+	}
+	ul := &userLimiter{
+		rate: rate,
+		up:   newTokenBucket(rate),
+		down: newTokenBucket(rate),
+	}
+	userLimiters.items[name] = ul
+	return ul
+}
+
+func (ul *userLimiter) upBucket() *tokenBucket {
+	if ul == nil {
+		return nil
+	}
+	return ul.up
+}
+
+func (ul *userLimiter) downBucket() *tokenBucket {
+	if ul == nil {
+		return nil
+	}
+	return ul.down
+}
+
+// rateLimitReader 读取时按照令牌桶限速
+type rateLimitReader struct {
+	R      io.Reader
+	bucket *tokenBucket
+	done   <-chan struct{}
+}
+
+func (r *rateLimitReader) Read(p []byte) (int, error) {
+	// 每次最多读取 1 秒的量，避免一次透支过多
+	if limit := int(r.bucket.rate); limit > 0 && len(p) > limit {
+		p = p[:limit]
+	}
+	n, err := r.R.Read(p)
+	if !r.bucket.wait(n, r.done) {
+		return n, errors.New("rate limit wait canceled")
+	}
+	return n, err
+}
+
+// rateLimitReadCloser 和 rateLimitReader 一样，用于请求 Body
+type rateLimitReadCloser struct {
+	rateLimitReader
+	io.Closer
+}
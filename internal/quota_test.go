@@ -0,0 +1,32 @@
+package internal
+
+import "testing"
+
+func TestLoadUserLimiter(t *testing.T) {
+	const name = "test-limiter"
+	ul := loadUserLimiter(name, 1)
+	if ul == nil || ul.up.rate != 1024 || ul.down.rate != 1024 {
+		t.Fatalf("got %+v", ul)
+	}
+	if loadUserLimiter(name, 1) != ul {
+		t.Fatal("should reuse the limiter while RateLimit is unchanged")
+	}
+
+	// 修改了 RateLimit
+	ul2 := loadUserLimiter(name, 2)
+	if ul2 == ul || ul2.up.rate != 2048 {
+		t.Fatalf("got %+v", ul2)
+	}
+
+	// 改为 0 后不再限速
+	if got := loadUserLimiter(name, 0); got != nil {
+		t.Fatalf("got %+v, want nil", got)
+	}
+	if _, ok := userLimiters.items[name]; ok {
+		t.Fatal("limiter should be removed")
+	}
+	var none *userLimiter
+	if none.upBucket() != nil || none.downBucket() != nil {
+		t.Fatal("nil limiter should have nil buckets")
+	}
+}
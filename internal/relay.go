@@ -1,15 +1,15 @@
 package internal
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
@@ -28,8 +28,11 @@ type reply struct {
 	usedSuccess atomic.Int64
 }
 
-func getRetryWithRequest(req *http.Request) int {
+func getRetryWithRequest(req *http.Request, user *User) int {
 	str := req.Header.Get("X-Man-Retry")
+	if str == "" && user != nil && user.Options.Retry > 0 {
+		return min(user.Options.Retry, getProxyRetryMax())
+	}
 	if str == "" {
 		return getProxyRetry()
 	}
@@ -48,6 +51,9 @@ func (hc *reply) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	user := getProxyAuthorInfo(req)
 
 	xlog.AddAttr(ctx, xlog.String("User", user.Name))
+	if !user.Options.IsZero() {
+		xlog.AddAttr(ctx, xlog.String("UserOptions", fmt.Sprintf("%+v", user.Options)))
+	}
 
 	if !checkHTTPAuth(user) {
 		xlog.AddAttr(ctx, xlog.String("Error", "auth failed"), xlog.String("ErrPassword", user.Password))
@@ -61,8 +67,33 @@ func (hc *reply) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		defer req.Body.Close()
 	}
 
+	if err := checkUserQuota(user.Name); err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err))
+		writeQuotaExceeded(w, err)
+		return
+	}
+
+	release, err := acquireUserLimit(ctx, user.Name)
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err))
+		writeTooManyRequests(w, err)
+		return
+	}
+	defer release()
+
+	strategy := getStrategyWithRequest(req, user)
+	xlog.AddAttr(ctx, xlog.String("Strategy", strategy.Name()))
+	ctx = contextWithStrategy(ctx, strategy)
+	req = req.WithContext(ctx)
+
+	if id := getSessionWithRequest(req, user); id != "" {
+		xlog.AddAttr(ctx, xlog.String("Session", id))
+		ctx = contextWithSession(ctx, sessions.Get(user.Name, id))
+		req = req.WithContext(ctx)
+	}
+
 	if req.Method == http.MethodConnect {
-		hc.handleConnect(w, req)
+		hc.handleConnect(w, req, user)
 		return
 	}
 
@@ -84,22 +115,39 @@ func (hc *reply) handleHTTP(w http.ResponseWriter, req *http.Request, user *User
 		return
 	}
 
-	body, err := io.ReadAll(req.Body)
+	host, port, err := getHostPortFromURL(req.RequestURI)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("cannot read body:" + err.Error()))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ctx, filter, err := applyRoute(req.Context(), newRouteTarget(req.Context(), host, port, user.Name), getFilterWithRequest(req, user))
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err = checkFilter(filter); err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err))
+		writeFilterError(w, err)
 		return
 	}
 
-	rr, err := http.NewRequestWithContext(req.Context(), req.Method, req.RequestURI, nil)
+	body, err := newReplayBody(w, req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	rr.GetBody = func() (io.ReadCloser, error) {
-		return io.NopCloser(bytes.NewReader(body)), nil
+
+	rr, err := http.NewRequestWithContext(ctx, req.Method, req.RequestURI, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
 	}
+	rr.ContentLength = req.ContentLength
 
 	for k, v := range req.Header {
 		if isProxyHeader(k) {
@@ -112,75 +160,267 @@ func (hc *reply) handleHTTP(w http.ResponseWriter, req *http.Request, user *User
 
 	param := forwardParam{
 		Request:  rr,
+		Body:     body,
 		Username: user.Name,
-		Attempt:  getRetryWithRequest(req) + 1,
+		Filter:   filter,
+		Attempt:  getRetryWithRequest(req, user) + 1,
+		Hedge:    getHedgeWithRequest(req, user),
+		Format:   getFormatWithRequest(req, user),
 	}
-	hc.forwardRequest(req.Context(), w, param)
+	if isUpgradeRequest(req) {
+		hc.forwardUpgrade(ctx, w, param, getTunnelTimeouts(ctx, user))
+		return
+	}
+	hc.forwardRequest(ctx, w, param)
 }
 
 type forwardParam struct {
-	Request  *http.Request
+	Request *http.Request
+
+	// 请求 Body，会在每次尝试时重放，为 nil 时表示没有 Body
+	Body *replayBody
+
 	Username string
 
 	Filter string
 
 	Attempt int // 总尝试次数，retry+1
 
+	// 是否最后一次尝试，最后一次时即使被目标网站封禁了（见 BanRules），也返回响应
+	lastTry bool
+
+	// 对冲请求数，大于 1 时，首次尝试会同时通过多个代理发送，使用最快的响应
+	Hedge int
+
 	// 输出格式：默认为空，即原样输出
 	// clean: 输出清理过的 html 代码
 	Format string
 }
 
+// newRequest 为每一次尝试创建新的请求，若 Body 已不能重放，返回 errBodyNotReplayable
+func (fp *forwardParam) newRequest(ctx context.Context) (*http.Request, error) {
+	rr := fp.Request.Clone(ctx)
+	if fp.Body == nil {
+		return rr, nil
+	}
+	body, err := fp.Body.Reader()
+	if err != nil {
+		return nil, err
+	}
+	rr.Body = body
+	rr.GetBody = fp.Body.Reader
+	if bucket := getUserLimiter(fp.Username).upBucket(); bucket != nil {
+		rr.Body = &rateLimitReadCloser{
+			rateLimitReader: rateLimitReader{R: body, bucket: bucket, done: ctx.Done()},
+			Closer:          body,
+		}
+	}
+	return rr, nil
+}
+
+// canHedge 是否可以对冲：幂等请求，并且 Body 可以完整的缓存下来供多个请求同时使用
+func (fp *forwardParam) canHedge() bool {
+	if fp.Hedge < 2 || !isIdempotent(fp.Request.Method) {
+		return false
+	}
+	if fp.Body == nil {
+		return true
+	}
+	if fp.Request.ContentLength <= 0 || fp.Request.ContentLength > getReplayBufferSize() {
+		return false
+	}
+	return fp.Body.ReadAll() == nil
+}
+
+// doRequest 通过指定的代理发送一次请求
+func (hc *reply) doRequest(ctx context.Context, param forwardParam, p *proxyEntry) (*http.Response, error) {
+	rr, err := param.newRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.State.UsedTotal.Add(1)
+
+	client, err := httpClientProxied(p.Base.URL)
+	if err != nil {
+		xlog.Warn(ctx, "get transport failed", xlog.ErrorAttr("Error", err), xlog.String("Proxy", p.Base.Proxy))
+		return nil, err
+	}
+	release := useProxyLimit(p)
+	p.State.Breaker.begin()
+	start := time.Now()
+	he := historyEntry{Time: start}
+	rr = rr.WithContext(httptrace.WithClientTrace(rr.Context(), &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			he.Connect = time.Since(start)
+		},
+	}))
+	resp, err := client.Do(rr)
+	he.Latency = time.Since(start)
+	if err != nil {
+		recordProxyResult(ctx, p, err)
+		he.Error = err.Error()
+		recordRelayHistory(ctx, p, he)
+		release()
+		return nil, err
+	}
+	he.Status = resp.StatusCode
+	if rule := matchBanRule(rr.URL.Hostname(), resp); rule != nil {
+		// 代理本身是正常的，只是被目标网站封禁了
+		he.Error = "banned: " + rule.Name
+		recordRelayHistory(ctx, p, he)
+		p.State.Breaker.record(true)
+		reputation.ban(ctx, p, rule.Name)
+		xlog.Warn(ctx, "proxy banned by target", xlog.String("Proxy", p.Base.Proxy), xlog.String("BanRule", rule.Name))
+		if !param.lastTry {
+			resp.Body.Close()
+			release()
+			return nil, fmt.Errorf("%w: %s", errProxyBanned, rule.Name)
+		}
+	} else {
+		recordProxyResult(ctx, p, nil)
+		he.OK = true
+		recordRelayHistory(ctx, p, he)
+	}
+	p.State.Latency.Observe(time.Since(start))
+	resp.Body = newReleaseBody(resp.Body, release)
+	return resp, nil
+}
+
+// hedgeRequest 同时通过多个代理发送请求，返回最快的响应
+func (hc *reply) hedgeRequest(ctx context.Context, param forwardParam) (*proxyEntry, *http.Response, context.CancelFunc, error) {
+	proxies, err := pool.getProxiesActive(ctx, param.Filter, param.Hedge)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	xlog.AddAttr(ctx, xlog.Int("Hedge", len(proxies)))
+	return hedge(ctx, proxies, listenerFromContext(ctx).getHedgeDelay(),
+		func(ctx context.Context, p *proxyEntry) (*http.Response, error) {
+			return hc.doRequest(ctx, param, p)
+		},
+		func(resp *http.Response) {
+			resp.Body.Close()
+		},
+	)
+}
+
 // forwardParam 转发代理请求，rr *http.Request 是要经过代理服务器的请求信息
 func (hc *reply) forwardRequest(ctx context.Context, w http.ResponseWriter, param forwardParam) {
+	if param.Body != nil {
+		defer param.Body.Close()
+	}
+	release, err := waitDomainLimit(ctx, param.Request.URL.Hostname())
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "waitDomainLimit"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
 	var p *proxyEntry
-	var err error
 	var resp *http.Response
 	var i int
-	for i = 0; i < param.Attempt; i++ {
+	var tier filterTier
+	tiers := getFilterTiers(param.Filter)
+	total := tiers.total(param.Attempt)
+	for i = 0; i < total; i++ {
 		hc.usedTotal.Add(1)
-		p, err = pool.getOneProxyActive(ctx, param.Filter)
-		if err != nil {
-			xlog.Warn(ctx, "getOneProxyActive failed", xlog.ErrorAttr("Error", err))
+		param.lastTry = i == total-1
+		tier = tiers.at(i, param.Attempt)
+		if i == 0 && !tier.Direct && param.canHedge() {
+			var cancel context.CancelFunc
+			hp := param
+			hp.Filter = tier.Filter
+			p, resp, cancel, err = hc.hedgeRequest(ctx, hp)
+			if err == nil {
+				defer cancel()
+				break
+			}
+			xlog.Warn(ctx, "hedge request failed", xlog.ErrorAttr("Error", err))
 			continue
 		}
 
-		p.State.UsedTotal.Add(1)
-
-		client, err := httpClientProxied(p.Base.URL)
+		p, err = tier.pick(ctx)
 		if err != nil {
-			xlog.Warn(ctx, "get transport failed", xlog.ErrorAttr("Error", err), xlog.String("Proxy", p.Base.Proxy))
+			xlog.Warn(ctx, "getOneProxyActive failed", xlog.ErrorAttr("Error", err), xlog.String("Tier", tier.Name))
+			// 这一层没有可用的代理，直接使用下一层
+			i = tiers.skip(i, param.Attempt)
 			continue
 		}
 
-		resp, err = client.Do(param.Request)
-		if err != nil {
-			xlog.Warn(ctx, "fetch response failed", xlog.ErrorAttr("Error", err))
-			continue
+		resp, err = hc.doRequest(ctx, param, p)
+		if err == nil {
+			break
 		}
-		break
+		xlog.Warn(ctx, "fetch response failed", xlog.ErrorAttr("Error", err), xlog.String("Proxy", p.Base.Proxy))
+		if errors.Is(err, errBodyNotReplayable) || param.Body.TooLarge() {
+			break
+		}
+	}
+
+	if tier.Name != "" {
+		xlog.AddAttr(ctx, xlog.String("Tier", tier.Name))
+		w.Header().Set("X-Man-Tier", tier.Name)
+	}
+
+	if resp == nil {
+		status := http.StatusBadGateway
+		if param.Body.TooLarge() {
+			status = http.StatusRequestEntityTooLarge
+			err = errRequestTooLarge
+		}
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "forwardRequest"))
+		w.WriteHeader(status)
+		w.Write([]byte(fmt.Sprintf("forward request failed (attempt %d): %v", i, err)))
+		return
 	}
 
 	defer resp.Body.Close()
 
 	resp.Header.Del("Connection")
 
+	rd, err := limitResponseBody(resp)
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.Int64("ContentLength", resp.ContentLength))
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if bucket := getUserLimiter(param.Username).downBucket(); bucket != nil {
+		rd = &rateLimitReader{R: rd, bucket: bucket, done: ctx.Done()}
+	}
+
+	var down int64
+	defer func() {
+		tk := newTrafficKey(ctx, param.Username, p, param.Request.URL.Hostname())
+		tk.Tier = tier.Name
+		traffic.Add(tk, param.Body.Size(), down)
+	}()
+
 	copyProxyResponseHeaders(w.Header(), resp.Header)
-	w.Header().Set("X-Man-Attempt", fmt.Sprintf("%d/%d", i, param.Attempt))
+	w.Header().Set("X-Man-Attempt", fmt.Sprintf("%d/%d", i, total))
 	w.Header().Set("X-Man-Via", p.Base.URL.Hostname())
+	if r := routeRuleFromContext(ctx); r != nil {
+		w.Header().Set("X-Man-Rule", r.Name)
+	}
 
 	if strings.Contains(resp.Header.Get("Content-Type"), "text/html") && param.Format == "clean" {
-		var rd io.Reader = resp.Body
-		if num := getMaxResponseSize(); num > 0 {
-			rd = io.LimitReader(rd, num)
+		bf, err := htmlsanitize.CleanReader(rd)
+		if errors.Is(err, errResponseTooLarge) {
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
 		}
-		bf, _ := htmlsanitize.CleanReader(rd)
 		w.Header().Set("Content-Length", strconv.Itoa(len(bf)))
 		w.WriteHeader(resp.StatusCode)
-		w.Write(bf)
+		n, _ := w.Write(bf)
+		down = int64(n)
 	} else {
 		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		down, _ = writeResponseBody(w, rd)
 	}
 
 	p.State.UsedSuccess.Add(1)
@@ -192,18 +432,54 @@ func (hc *reply) getClientConn(w http.ResponseWriter) (net.Conn, error) {
 	if !ok {
 		return nil, fmt.Errorf("%T not http.Hijacker", w)
 	}
-	conn, _, err := hj.Hijack()
-	return conn, err
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// 客户端可能已经发送了后续的数据，如 WebSocket 的首个帧
+	if brw.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, rd: brw.Reader}, nil
+	}
+	return conn, nil
 }
 
 // handleConnect 处理 CONNECT 请求
-func (hc *reply) handleConnect(w http.ResponseWriter, req *http.Request) {
-	if _, _, err := net.SplitHostPort(req.RequestURI); err != nil {
+func (hc *reply) handleConnect(w http.ResponseWriter, req *http.Request, user *User) {
+	host, port, err := parseHostPort(req.RequestURI)
+	if err != nil || port == 0 {
 		xlog.AddAttr(req.Context(), xlog.ErrorAttr("Error", err), xlog.String("Action", "handleConnect"))
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte("invalid connect request with uri: " + req.RequestURI))
 		return
 	}
+	ctx, filter, err := applyRoute(req.Context(), newRouteTarget(req.Context(), host, port, user.Name), getFilterWithRequest(req, user))
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err = checkFilter(filter); err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err))
+		writeFilterError(w, err)
+		return
+	}
+	req = req.WithContext(ctx)
+
+	// 解密后的每个请求单独限制，见 handleMITM
+	mitm := isMITMEnabled(ctx, user)
+	if !mitm {
+		// 在劫持连接之前等待，以便失败时可以返回 503
+		release, err := waitDomainLimit(ctx, host)
+		if err != nil {
+			xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "waitDomainLimit"))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer release()
+	}
+
 	conn, err := hc.getClientConn(w)
 	if err != nil {
 		xlog.AddAttr(req.Context(), xlog.ErrorAttr("Error", err), xlog.String("Action", "getClientConn"))
@@ -213,78 +489,135 @@ func (hc *reply) handleConnect(w http.ResponseWriter, req *http.Request) {
 	}
 	defer conn.Close()
 
-	filter := req.Header.Get("X-Man-Filter")
+	if mitm {
+		hc.handleMITM(ctx, conn, req, user, filter)
+		return
+	}
+
+	tt := getTunnelTimeouts(ctx, user)
+	attempt := getRetryWithRequest(req, user) + 1
 	// CONNECT 请求的 RequestURI 就是目标地址 如 example.com:443
-	one, sConn, err := hc.getProxyServerConn(req.Context(), filter, getRetryWithRequest(req)+1, req.RequestURI)
+	one, tier, sConn, err := hc.getProxyServerConn(req.Context(), filter, attempt, getHedgeWithRequest(req, user), req.RequestURI, tt.Connect)
+	if tier.Name != "" {
+		xlog.AddAttr(ctx, xlog.String("Tier", tier.Name))
+	}
 	if err != nil {
 		xlog.AddAttr(req.Context(), xlog.ErrorAttr("Error", err), xlog.String("Action", "getProxyServerConn"))
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte("connect to proxy server failed:" + err.Error()))
+		// 连接已被劫持，只能直接写入
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
 		return
 	}
 	defer sConn.Close()
 
-	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	established := "HTTP/1.1 200 Connection Established\r\n"
+	if tier.Name != "" {
+		established += "X-Man-Tier: " + tier.Name + "\r\n"
+	}
+	_, err = conn.Write([]byte(established + "\r\n"))
 	if err != nil {
 		xlog.AddAttr(req.Context(), xlog.ErrorAttr("Error", err), xlog.String("Action", "send Connection Established"))
 		return
 	}
 
-	deadLine := time.Now().Add(getProxyTimeout())
-	sConn.SetDeadline(deadLine)
-
-	var closeOnce sync.Once
-	doClose := func() {
-		closeOnce.Do(func() {
-			sConn.Close()
-			conn.Close()
-		})
-	}
-
-	var wg sync.WaitGroup
-	wg.Go(func() {
-		n, e := io.Copy(conn, sConn)
-		xlog.AddAttr(req.Context(), xlog.Int64("CopyToClientN", n), xlog.ErrorAttr("CopyToClientErr", e))
-		doClose()
-	})
-	wg.Go(func() {
-		n, e := io.Copy(sConn, conn)
-		xlog.AddAttr(req.Context(), xlog.Int64("CopyToServerN", n), xlog.ErrorAttr("CopyToServerErr", e))
-		doClose()
-	})
-	wg.Go(func() {
-		<-req.Context().Done()
-		doClose()
-	})
-	wg.Wait()
+	tk := newTrafficKey(ctx, user.Name, one, host)
+	tk.Tier = tier.Name
+	hc.pipe(req.Context(), conn, one, sConn, tt, tk)
+}
+
+// pipe 在客户端和代理服务器的连接之间双向的转发数据，直到任意一方关闭或者超时
+func (hc *reply) pipe(ctx context.Context, conn io.ReadWriteCloser, one *proxyEntry, sConn io.ReadWriteCloser, tt tunnelTimeouts, tk trafficKey) {
+	ul := getUserLimiter(tk.User)
+	t := &tunnel{
+		client:    conn,
+		server:    sConn,
+		timeouts:  tt,
+		upLimit:   ul.upBucket(),
+		downLimit: ul.downBucket(),
+		account: func(up int64, down int64) error {
+			traffic.Add(tk, up, down)
+			return checkUserQuota(tk.User)
+		},
+	}
+	reason := t.run(ctx)
+	xlog.AddAttr(ctx, xlog.String("CloseReason", reason))
 	one.State.UsedSuccess.Add(1)
 }
 
-func (hc *reply) getProxyServerConn(ctx context.Context, filter string, attempt int, targetAddr string) (*proxyEntry, net.Conn, error) {
-	for i := 0; i < attempt; i++ {
+// getProxyServerConn 通过代理连接目标地址，timeout 为每次连接的超时时间，
+// filter 分层时，每一层尝试 attempt 次，返回实际使用的层
+func (hc *reply) getProxyServerConn(ctx context.Context, filter string, attempt int, hedgeNum int, targetAddr string, timeout time.Duration) (*proxyEntry, filterTier, net.Conn, error) {
+	connect := func(ctx context.Context, one *proxyEntry) (net.Conn, error) {
+		// 每拿出来依次使用计数就+1，在交互成功后，给成功计数器+1
+		one.State.UsedTotal.Add(1)
+
+		tr, err := transport.Get(one.Base.URL)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		release := useProxyLimit(one)
+		one.State.Breaker.begin()
+		start := time.Now()
+		conn, err := tr.Connect(ctx, "tcp", targetAddr)
+		recordProxyResult(ctx, one, err)
+		he := historyEntry{Time: start, OK: err == nil, Connect: time.Since(start), Latency: time.Since(start)}
+		if err != nil {
+			he.Error = err.Error()
+		}
+		recordRelayHistory(ctx, one, he)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		one.State.Latency.Observe(time.Since(start))
+		return &notifyCloseConn{Conn: conn, onClose: func() error {
+			release()
+			return nil
+		}}, nil
+	}
+
+	tiers := getFilterTiers(filter)
+	total := tiers.total(attempt)
+	var tier filterTier
+	for i := 0; i < total; i++ {
 		select {
 		case <-ctx.Done():
-			return nil, nil, context.Cause(ctx)
+			return nil, tier, nil, context.Cause(ctx)
 		default:
 		}
-		one, err := pool.getOneProxyActive(ctx, filter)
-		if err != nil {
+
+		tier = tiers.at(i, attempt)
+		if i == 0 && hedgeNum > 1 && !tier.Direct {
+			proxies, err := pool.getProxiesActive(ctx, tier.Filter, hedgeNum)
+			if err != nil {
+				continue
+			}
+			xlog.AddAttr(ctx, xlog.Int("Hedge", len(proxies)))
+			delay := listenerFromContext(ctx).getHedgeDelay()
+			one, conn, cancel, err := hedge(ctx, proxies, delay, connect, func(conn net.Conn) {
+				conn.Close()
+			})
+			if err == nil {
+				// 连接已建立，不再依赖 ctx
+				cancel()
+				return one, tier, conn, nil
+			}
 			continue
 		}
 
-		// 每拿出来依次使用计数就+1，在交互成功后，给成功计数器+1
-		one.State.UsedTotal.Add(1)
-
-		tr, err := transport.Get(one.Base.URL)
+		one, err := tier.pick(ctx)
 		if err != nil {
-			return one, nil, err
+			// 这一层没有可用的代理，直接使用下一层
+			i = tiers.skip(i, attempt)
+			continue
 		}
-		conn, err := tr.Connect(ctx, "tcp", targetAddr)
+		conn, err := connect(ctx, one)
 		if err == nil {
-			return one, conn, nil
+			return one, tier, conn, nil
 		}
 	}
-	return nil, nil, fmt.Errorf("failed to connect to proxy server (attempt %d)", attempt)
+	return nil, tier, nil, fmt.Errorf("failed to connect to proxy server (attempt %d)", total)
 }
 
 func copyProxyResponseHeaders(dst, src http.Header) {
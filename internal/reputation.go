@@ -0,0 +1,393 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xctx"
+	"golang.org/x/net/publicsuffix"
+)
+
+// reputationConfig 代理在各个目标域名上的信誉，app.yml 中的 Reputation
+type reputationConfig struct {
+	HalfLife    int `yaml:"HalfLife"`    // 成功和失败次数的半衰期，单位秒，默认 3600
+	BanDuration int `yaml:"BanDuration"` // 命中 BanRules 后，多久内不再使用该代理访问该域名，单位秒，默认 1800
+}
+
+func getReputationConfig() (halfLife time.Duration, banDuration time.Duration) {
+	cfg := getAppConfig().Reputation
+	halfLife, banDuration = time.Hour, 30*time.Minute
+	if cfg.HalfLife > 0 {
+		halfLife = time.Duration(cfg.HalfLife) * time.Second
+	}
+	if cfg.BanDuration > 0 {
+		banDuration = time.Duration(cfg.BanDuration) * time.Second
+	}
+	return halfLife, banDuration
+}
+
+// banRuleConfig 判断代理被目标网站封禁的规则，配置在 app.yml 的 BanRules 中，
+// 所有配置了的条件都需要满足，Status 和 Body 至少需要配置一个
+type banRuleConfig struct {
+	Name   string   `yaml:"Name"`
+	Domain []string `yaml:"Domain"` // 域名后缀，为空时对所有域名有效
+	Status []int    `yaml:"Status"` // 响应状态码，如 403、429
+	Body   string   `yaml:"Body"`   // 响应 Body 的正则，只检查前 64KB
+}
+
+type banRule struct {
+	banRuleConfig
+	body *regexp.Regexp
+}
+
+// banBodyPeekSize 检查 Body 时最多读取的长度
+const banBodyPeekSize = 64 * 1024
+
+var errProxyBanned = errors.New("proxy banned by target")
+
+func newBanRule(index int, cfg *banRuleConfig) (*banRule, error) {
+	r := &banRule{banRuleConfig: *cfg}
+	if r.Name == "" {
+		r.Name = "ban#" + strconv.Itoa(index+1)
+	}
+	for i, domain := range r.Domain {
+		r.Domain[i] = strings.ToLower(strings.Trim(domain, ". "))
+	}
+	if len(r.Status) == 0 && r.Body == "" {
+		return nil, fmt.Errorf("ban rule %q: Status or Body is required", r.Name)
+	}
+	if r.Body != "" {
+		reg, err := regexp.Compile(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("ban rule %q: invalid Body %q: %w", r.Name, r.Body, err)
+		}
+		r.body = reg
+	}
+	return r, nil
+}
+
+func (r *banRule) matchHead(host string, status int) bool {
+	if len(r.Domain) > 0 && !slices.ContainsFunc(r.Domain, func(domain string) bool {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}) {
+		return false
+	}
+	return len(r.Status) == 0 || slices.Contains(r.Status, status)
+}
+
+var banRules []*banRule
+
+func loadBanRules() []*banRule {
+	var rules []*banRule
+	for i, cfg := range getAppConfig().BanRules {
+		r, err := newBanRule(i, cfg)
+		if err != nil {
+			log.Fatalln("load BanRules failed:", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matchBanRule 判断响应是否表示代理被目标网站封禁了，需要检查 Body 时，
+// 会读取 Body 的前一部分，并替换 resp.Body 使其仍然可以完整读取
+func matchBanRule(host string, resp *http.Response) *banRule {
+	if len(banRules) == 0 || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	host = strings.ToLower(host)
+	var head []byte
+	var peeked bool
+	for _, r := range banRules {
+		if !r.matchHead(host, resp.StatusCode) {
+			continue
+		}
+		if r.body == nil {
+			return r
+		}
+		if !peeked {
+			peeked = true
+			var err error
+			head, err = io.ReadAll(io.LimitReader(resp.Body, banBodyPeekSize))
+			resp.Body = &struct {
+				io.Reader
+				io.Closer
+			}{
+				Reader: io.MultiReader(bytes.NewReader(head), &errReader{err: err}, resp.Body),
+				Closer: resp.Body,
+			}
+		}
+		if r.body.Match(head) {
+			return r
+		}
+	}
+	return nil
+}
+
+// errReader 读取时返回指定的错误，err 为 nil 时返回 io.EOF
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	if r.err == nil {
+		return 0, io.EOF
+	}
+	return 0, r.err
+}
+
+// registrableDomain 返回可注册的域名，如 www.example.co.uk -> example.co.uk，IP 原样返回
+func registrableDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || net.ParseIP(host) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+var ctxKeyTargetDomain = xctx.NewKey()
+
+func contextWithTargetHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, ctxKeyTargetDomain, registrableDomain(host))
+}
+
+// targetDomainFromContext 请求的目标地址的可注册域名
+func targetDomainFromContext(ctx context.Context) string {
+	domain, _ := ctx.Value(ctxKeyTargetDomain).(string)
+	return domain
+}
+
+// reputationScore 一个代理在一个域名上的成功和失败次数，随着时间衰减
+type reputationScore struct {
+	Success     float64
+	Failure     float64
+	Updated     time.Time
+	BannedUntil time.Time
+	BanRule     string // 最后一次命中的封禁规则
+}
+
+// decay 按照半衰期衰减到 now，需要在锁内调用
+func (rs *reputationScore) decay(now time.Time, halfLife time.Duration) {
+	if !rs.Updated.IsZero() {
+		factor := math.Exp2(-now.Sub(rs.Updated).Seconds() / halfLife.Seconds())
+		rs.Success *= factor
+		rs.Failure *= factor
+	}
+	rs.Updated = now
+}
+
+// Score 成功率的估计值，没有记录时为 0.5
+func (rs *reputationScore) Score() float64 {
+	return (rs.Success + 1) / (rs.Success + rs.Failure + 2)
+}
+
+func (rs *reputationScore) isBanned(now time.Time) bool {
+	return now.Before(rs.BannedUntil)
+}
+
+// reputationStore 代理在各个目标域名上的信誉：域名 -> 代理地址 -> 分数
+type reputationStore struct {
+	mux     sync.Mutex
+	domains map[string]map[string]*reputationScore
+}
+
+var reputation = &reputationStore{
+	domains: make(map[string]map[string]*reputationScore),
+}
+
+// get 返回分数，create 为 false 且不存在时返回 nil，需要在锁内调用
+func (rs *reputationStore) get(domain string, proxy string, create bool) *reputationScore {
+	items := rs.domains[domain]
+	if items == nil {
+		if !create {
+			return nil
+		}
+		items = make(map[string]*reputationScore)
+		rs.domains[domain] = items
+	}
+	score := items[proxy]
+	if score == nil && create {
+		score = &reputationScore{}
+		items[proxy] = score
+	}
+	return score
+}
+
+// record 记录一次通过代理访问目标域名的结果
+func (rs *reputationStore) record(ctx context.Context, p *proxyEntry, ok bool) {
+	domain := targetDomainFromContext(ctx)
+	if domain == "" {
+		return
+	}
+	halfLife, _ := getReputationConfig()
+	now := time.Now()
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	score := rs.get(domain, p.Base.Proxy, true)
+	score.decay(now, halfLife)
+	if ok {
+		score.Success++
+	} else {
+		score.Failure++
+	}
+}
+
+// ban 代理被目标域名封禁了，在 BanDuration 内不再使用
+func (rs *reputationStore) ban(ctx context.Context, p *proxyEntry, rule string) {
+	domain := targetDomainFromContext(ctx)
+	if domain == "" {
+		return
+	}
+	halfLife, banDuration := getReputationConfig()
+	now := time.Now()
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	score := rs.get(domain, p.Base.Proxy, true)
+	score.decay(now, halfLife)
+	score.Failure++
+	score.BannedUntil = now.Add(banDuration)
+	score.BanRule = rule
+}
+
+// scores 返回 list 中每个代理在 domain 上的分数，以及是否被封禁
+func (rs *reputationStore) scores(domain string, list []*proxyEntry) (scores []float64, banned []bool) {
+	scores = make([]float64, len(list))
+	banned = make([]bool, len(list))
+	halfLife, _ := getReputationConfig()
+	now := time.Now()
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	for i, p := range list {
+		scores[i] = 0.5
+		if domain == "" {
+			continue
+		}
+		if score := rs.get(domain, p.Base.Proxy, false); score != nil {
+			score.decay(now, halfLife)
+			scores[i] = score.Score()
+			banned[i] = score.isBanned(now)
+		}
+	}
+	return scores, banned
+}
+
+// avoidBanned 去掉被目标域名封禁了的代理，若全部都被封禁了，返回原列表
+func (rs *reputationStore) avoidBanned(domain string, list []*proxyEntry) []*proxyEntry {
+	if domain == "" {
+		return list
+	}
+	_, banned := rs.scores(domain, list)
+	if !slices.Contains(banned, true) || !slices.Contains(banned, false) {
+		return list
+	}
+	result := make([]*proxyEntry, 0, len(list))
+	for i, p := range list {
+		if !banned[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// clean 清理衰减到几乎为 0 并且未被封禁的记录
+func (rs *reputationStore) clean() {
+	halfLife, _ := getReputationConfig()
+	now := time.Now()
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	for domain, items := range rs.domains {
+		for proxy, score := range items {
+			score.decay(now, halfLife)
+			if score.Success+score.Failure < 0.01 && !score.isBanned(now) {
+				delete(items, proxy)
+			}
+		}
+		if len(items) == 0 {
+			delete(rs.domains, domain)
+		}
+	}
+}
+
+// Domains 所有有记录的域名，按照记录的代理数倒序
+func (rs *reputationStore) Domains() []KV {
+	rs.mux.Lock()
+	result := make([]KV, 0, len(rs.domains))
+	for domain, items := range rs.domains {
+		result = append(result, KV{Key: domain, Value: len(items)})
+	}
+	rs.mux.Unlock()
+	slices.SortFunc(result, func(a, b KV) int {
+		if d := b.Value.(int) - a.Value.(int); d != 0 {
+			return d
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return result
+}
+
+// Proxies 在 domain 上有记录的代理，按照分数倒序
+func (rs *reputationStore) Proxies(domain string) []map[string]any {
+	halfLife, _ := getReputationConfig()
+	now := time.Now()
+	rs.mux.Lock()
+	items := rs.domains[registrableDomain(domain)]
+	result := make([]map[string]any, 0, len(items))
+	for proxy, score := range items {
+		score.decay(now, halfLife)
+		info := map[string]any{
+			"Proxy":   proxy,
+			"Score":   math.Round(score.Score()*1000) / 1000,
+			"Success": math.Round(score.Success*10) / 10,
+			"Failure": math.Round(score.Failure*10) / 10,
+			"Banned":  score.isBanned(now),
+			"Active":  pool.active.Get(proxy) != nil,
+			"BanRule": score.BanRule,
+
+			"BannedUntil": "",
+		}
+		if score.isBanned(now) {
+			info["BannedUntil"] = score.BannedUntil.Format(timeFormatStd)
+		}
+		result = append(result, info)
+	}
+	rs.mux.Unlock()
+	slices.SortFunc(result, func(a, b map[string]any) int {
+		if c := compareBool(a["Banned"].(bool), b["Banned"].(bool)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b["Score"].(float64), a["Score"].(float64)); c != 0 {
+			return c
+		}
+		return strings.Compare(a["Proxy"].(string), b["Proxy"].(string))
+	})
+	return result
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
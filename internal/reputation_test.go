@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReputationScoreDecay(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    float64 // 衰减后的成功次数，原来为 8
+	}{
+		{name: "no time", elapsed: 0, want: 8},
+		{name: "one half life", elapsed: time.Hour, want: 4},
+		{name: "three half lives", elapsed: 3 * time.Hour, want: 1},
+		{name: "half of half life", elapsed: 30 * time.Minute, want: 8 / math.Sqrt2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &reputationScore{Success: 8, Failure: 8, Updated: now}
+			rs.decay(now.Add(tt.elapsed), time.Hour)
+			if math.Abs(rs.Success-tt.want) > 1e-9 || math.Abs(rs.Failure-tt.want) > 1e-9 {
+				t.Fatalf("got %v/%v, want %v", rs.Success, rs.Failure, tt.want)
+			}
+			if !rs.Updated.Equal(now.Add(tt.elapsed)) {
+				t.Fatalf("Updated=%s", rs.Updated)
+			}
+		})
+	}
+
+	// 首次记录时不衰减
+	rs := &reputationScore{Success: 1}
+	rs.decay(now, time.Hour)
+	if rs.Success != 1 || !rs.Updated.Equal(now) {
+		t.Fatalf("got %+v", rs)
+	}
+	if got := (&reputationScore{}).Score(); got != 0.5 {
+		t.Fatalf("Score()=%v, want 0.5", got)
+	}
+}
+
+func TestReputationAvoidBanned(t *testing.T) {
+	setTestAppConfig(t, &appConfig{})
+	a, b, c := newProxy("http://127.0.0.1:1"), newProxy("http://127.0.0.1:2"), newProxy("http://127.0.0.1:3")
+	all := []*proxyEntry{a, b, c}
+	tests := []struct {
+		name   string
+		banned []*proxyEntry // 在 example.com 上被封禁的
+		domain string
+		want   []*proxyEntry
+	}{
+		{name: "none banned", domain: "example.com", want: all},
+		{name: "one banned", banned: []*proxyEntry{b}, domain: "example.com", want: []*proxyEntry{a, c}},
+		{name: "all banned", banned: all, domain: "example.com", want: all},
+		{name: "other domain", banned: []*proxyEntry{b}, domain: "example.org", want: all},
+		{name: "no domain", banned: []*proxyEntry{b}, want: all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &reputationStore{domains: make(map[string]map[string]*reputationScore)}
+			ctx := contextWithTargetHost(context.Background(), "www.example.com")
+			for _, p := range tt.banned {
+				rs.ban(ctx, p, "test")
+			}
+			rs.record(ctx, a, true)
+			if got := rs.avoidBanned(tt.domain, all); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchBanRule(t *testing.T) {
+	old := banRules
+	t.Cleanup(func() {
+		banRules = old
+	})
+	var rules []*banRule
+	for i, cfg := range []*banRuleConfig{
+		{Name: "captcha", Domain: []string{"example.com"}, Body: "captcha"},
+		{Status: []int{429}},
+	} {
+		r, err := newBanRule(i, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	banRules = rules
+
+	tests := []struct {
+		host   string
+		status int
+		body   string
+		want   string
+	}{
+		{host: "www.example.com", status: 200, body: "please solve the captcha", want: "captcha"},
+		{host: "www.example.com", status: 200, body: "hello"},
+		{host: "example.org", status: 200, body: "captcha"},
+		{host: "example.org", status: 429, want: "ban#2"},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))}
+		var got string
+		if r := matchBanRule(tt.host, resp); r != nil {
+			got = r.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s %d %q: got %q, want %q", tt.host, tt.status, tt.body, got, tt.want)
+		}
+		// 检查过 Body 后仍然可以完整读取
+		if bf, err := io.ReadAll(resp.Body); err != nil || string(bf) != tt.body {
+			t.Errorf("%s: body=%q, err=%v", tt.host, bf, err)
+		}
+	}
+}
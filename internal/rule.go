@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xctx"
+	"github.com/xanygo/anygo/ds/xsync"
+	"github.com/xanygo/anygo/xlog"
+)
+
+// 规则的动作
+const (
+	routeActionDirect = "direct" // 不使用代理，直接访问
+	routeActionReject = "reject" // 拒绝访问
+	routeActionFilter = "filter" // 使用满足 Filter 条件的代理
+	routeActionProxy  = "proxy"  // 使用指定的代理 Proxy
+)
+
+var errRouteReject = errors.New("rejected by route rule")
+
+// routeRuleConfig 路由规则的配置，配置在 app.yml 的 Rules 中，按照顺序匹配，使用第一个匹配的规则。
+// 同一个规则中，所有配置了的条件都需要满足，每个条件的多个值满足其一即可
+type routeRuleConfig struct {
+	Name string `yaml:"Name"`
+
+	Domain   []string `yaml:"Domain"`   // 域名后缀，如 example.com 可匹配 example.com 和 www.example.com
+	Keyword  []string `yaml:"Keyword"`  // 域名包含的关键字
+	Regex    []string `yaml:"Regex"`    // 域名的正则
+	CIDR     []string `yaml:"CIDR"`     // 目标 IP 段，只对目标地址是 IP 的请求有效
+	Country  []string `yaml:"Country"`  // 目标 IP 所在的国家代码，如 CN，需要配置 GeoIPFiles，域名会在本地解析
+	Port     []int    `yaml:"Port"`     // 目标端口
+	User     []string `yaml:"User"`     // 用户名
+	Listener []string `yaml:"Listener"` // 监听端口的名称，见 Listeners
+
+	Action string `yaml:"Action"` // direct | reject | filter | proxy
+	Filter string `yaml:"Filter"` // Action=filter 时，筛选代理的条件，同 X-Man-Filter
+	Proxy  string `yaml:"Proxy"`  // Action=proxy 时，使用的代理地址
+
+	// 是否解密 HTTPS 请求，只对 CONNECT 请求有效，此时 Action 可以为空
+	MITM bool `yaml:"MITM"`
+}
+
+type routeRule struct {
+	routeRuleConfig
+
+	regexps  []*regexp.Regexp
+	prefixes []netip.Prefix
+	proxy    *proxyEntry
+
+	Hits    atomic.Int64    // 匹配的次数
+	LastHit xsync.TimeStamp // 最后匹配的时间
+}
+
+func newRouteRule(index int, cfg *routeRuleConfig) (*routeRule, error) {
+	r := &routeRule{routeRuleConfig: *cfg}
+	if r.Name == "" {
+		r.Name = "rule#" + strconv.Itoa(index+1)
+	}
+	for i, domain := range r.Domain {
+		r.Domain[i] = strings.ToLower(strings.Trim(domain, ". "))
+	}
+	for i, word := range r.Keyword {
+		r.Keyword[i] = strings.ToLower(strings.TrimSpace(word))
+	}
+	for i, country := range r.Country {
+		r.Country[i] = strings.ToUpper(strings.TrimSpace(country))
+	}
+	for _, str := range r.Regex {
+		reg, err := regexp.Compile(str)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid Regex %q: %w", r.Name, str, err)
+		}
+		r.regexps = append(r.regexps, reg)
+	}
+	for _, str := range r.CIDR {
+		prefix, err := netip.ParsePrefix(str)
+		if err != nil {
+			addr, err1 := netip.ParseAddr(str)
+			if err1 != nil {
+				return nil, fmt.Errorf("rule %q: invalid CIDR %q: %w", r.Name, str, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.prefixes = append(r.prefixes, prefix.Masked())
+	}
+	switch r.Action {
+	case "":
+		if !r.MITM {
+			return nil, fmt.Errorf("rule %q: Action is required", r.Name)
+		}
+	case routeActionDirect, routeActionReject:
+	case routeActionFilter:
+		if r.Filter == "" {
+			return nil, fmt.Errorf("rule %q: Filter is required when Action=filter", r.Name)
+		}
+		if err := checkFilter(r.Filter); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	case routeActionProxy:
+		r.proxy = newProxy(r.Proxy)
+		if r.proxy == nil {
+			return nil, fmt.Errorf("rule %q: invalid Proxy %q", r.Name, r.Proxy)
+		}
+	default:
+		return nil, fmt.Errorf("rule %q: invalid Action %q", r.Name, r.Action)
+	}
+	return r, nil
+}
+
+// routeTarget 用于匹配规则的请求信息
+type routeTarget struct {
+	Host     string
+	Port     int
+	User     string
+	Listener string
+	Country  string // 目标 IP 所在的国家，只有规则中有 Country 条件时才会查询
+}
+
+func newRouteTarget(ctx context.Context, host string, port int, user string) routeTarget {
+	return routeTarget{
+		Host:     strings.ToLower(strings.TrimSuffix(host, ".")),
+		Port:     port,
+		User:     user,
+		Listener: listenerFromContext(ctx).Name,
+	}
+}
+
+func (r *routeRule) Match(t routeTarget) bool {
+	if len(r.Domain) > 0 && !slices.ContainsFunc(r.Domain, func(domain string) bool {
+		return t.Host == domain || strings.HasSuffix(t.Host, "."+domain)
+	}) {
+		return false
+	}
+	if len(r.Keyword) > 0 && !slices.ContainsFunc(r.Keyword, func(word string) bool {
+		return strings.Contains(t.Host, word)
+	}) {
+		return false
+	}
+	if len(r.regexps) > 0 && !slices.ContainsFunc(r.regexps, func(reg *regexp.Regexp) bool {
+		return reg.MatchString(t.Host)
+	}) {
+		return false
+	}
+	if len(r.prefixes) > 0 {
+		addr, err := netip.ParseAddr(t.Host)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(r.prefixes, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr)
+		}) {
+			return false
+		}
+	}
+	if len(r.Country) > 0 && !slices.Contains(r.Country, t.Country) {
+		return false
+	}
+	if len(r.Port) > 0 && !slices.Contains(r.Port, t.Port) {
+		return false
+	}
+	if len(r.User) > 0 && !slices.Contains(r.User, t.User) {
+		return false
+	}
+	if len(r.Listener) > 0 && !slices.Contains(r.Listener, t.Listener) {
+		return false
+	}
+	return true
+}
+
+type routeTable struct {
+	rules []*routeRule
+
+	// 是否有规则使用了 Country 条件，若有，匹配前需要查询目标 IP 的国家
+	withCountry bool
+}
+
+var routes = &routeTable{}
+
+func loadRouteTable() *routeTable {
+	rt := &routeTable{}
+	for i, cfg := range getAppConfig().Rules {
+		r, err := newRouteRule(i, cfg)
+		if err != nil {
+			log.Fatalln("load Rules failed:", err)
+		}
+		rt.rules = append(rt.rules, r)
+		rt.withCountry = rt.withCountry || len(r.Country) > 0
+	}
+	log.Println("load Rules success, total:", len(rt.rules))
+	return rt
+}
+
+// Match 按照顺序匹配，返回第一个匹配的规则，没有匹配的返回 nil
+func (rt *routeTable) Match(ctx context.Context, t routeTarget) *routeRule {
+	if rt.withCountry && t.Country == "" {
+		t.Country = lookupHostCountry(ctx, t.Host)
+	}
+	for _, r := range rt.rules {
+		if r.Match(t) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rt *routeTable) All() []*routeRule {
+	return rt.rules
+}
+
+var ctxKeyRouteRule = xctx.NewKey()
+
+func routeRuleFromContext(ctx context.Context) *routeRule {
+	r, _ := ctx.Value(ctxKeyRouteRule).(*routeRule)
+	return r
+}
+
+// applyRoute 匹配路由规则，并按照规则的动作返回新的 ctx 和 filter，
+// 规则的动作为 reject 时，返回 errRouteReject
+func applyRoute(ctx context.Context, t routeTarget, filter string) (context.Context, string, error) {
+	ctx = contextWithTargetHost(ctx, t.Host)
+	r := routes.Match(ctx, t)
+	if r == nil {
+		return ctx, filter, nil
+	}
+	r.Hits.Add(1)
+	r.LastHit.Store(time.Now())
+	xlog.AddAttr(ctx, xlog.String("Rule", r.Name), xlog.String("RuleAction", r.Action))
+	ctx = context.WithValue(ctx, ctxKeyRouteRule, r)
+	switch r.Action {
+	case routeActionDirect:
+		ctx = contextWithProxyEntry(ctx, directEntry)
+	case routeActionReject:
+		return ctx, filter, fmt.Errorf("%w: %s", errRouteReject, r.Name)
+	case routeActionFilter:
+		filter = r.Filter
+	case routeActionProxy:
+		if one := pool.all.Get(r.proxy.Base.Proxy); one != nil {
+			ctx = contextWithProxyEntry(ctx, one)
+		} else {
+			ctx = contextWithProxyEntry(ctx, r.proxy)
+		}
+	}
+	return ctx, filter, nil
+}
+
+// routeDecision 用于调试，展示一个目标地址会如何转发
+func routeDecision(ctx context.Context, t routeTarget) map[string]any {
+	result := map[string]any{
+		"Target":   net.JoinHostPort(t.Host, strconv.Itoa(t.Port)),
+		"User":     t.User,
+		"Listener": t.Listener,
+	}
+	if geoIP.Enabled() {
+		t.Country = lookupHostCountry(ctx, t.Host)
+		result["Country"] = t.Country
+	}
+	r := routes.Match(ctx, t)
+	if r == nil {
+		result["Rule"] = ""
+		result["Action"] = "default"
+		return result
+	}
+	result["Rule"] = r.Name
+	result["Action"] = r.Action
+	result["MITM"] = r.MITM
+	switch r.Action {
+	case routeActionFilter:
+		result["Filter"] = r.Filter
+	case routeActionProxy:
+		result["Proxy"] = r.Proxy
+	}
+	return result
+}
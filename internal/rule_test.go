@@ -0,0 +1,37 @@
+package internal
+
+import "testing"
+
+func TestRouteRuleMatch(t *testing.T) {
+	r, err := newRouteRule(0, &routeRuleConfig{
+		Domain:  []string{"Example.COM."},
+		Keyword: []string{" Google"},
+		Action:  routeActionDirect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := newRouteRule(1, &routeRuleConfig{
+		Keyword: []string{"Google"},
+		Action:  routeActionDirect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rule *routeRule
+		host string
+		want bool
+	}{
+		{rule: r, host: "google.example.com", want: true},
+		{rule: r, host: "example.com", want: false},
+		{rule: r, host: "google.com", want: false},
+		{rule: r2, host: "www.google.com", want: true},
+		{rule: r2, host: "example.com", want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Match(routeTarget{Host: tt.host}); got != tt.want {
+			t.Errorf("%s Match(%q)=%v, want %v", tt.rule.Name, tt.host, got, tt.want)
+		}
+	}
+}
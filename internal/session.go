@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xctx"
+	"github.com/xanygo/anygo/xattr"
+)
+
+// 会话保持的时长，每次使用后会延长
+func getSessionTTL() time.Duration {
+	val := xattr.GetDefault[time.Duration]("SessionTTL", 0)
+	if val > 0 {
+		return val * time.Second
+	}
+	return 600 * time.Second
+}
+
+// getSessionWithRequest 会话 ID，客户端通过 HTTP Header [X-Man-Session] 或者代理用户名指定
+func getSessionWithRequest(req *http.Request, user *User) string {
+	if str := strings.TrimSpace(req.Header.Get("X-Man-Session")); str != "" {
+		return str
+	}
+	if user != nil {
+		return user.Options.Session
+	}
+	return ""
+}
+
+// stickySession 会话保持：同一个会话在有效期内总是使用同一个代理
+type stickySession struct {
+	Key     string // User + ":" + ID
+	ID      string
+	User    string
+	Created time.Time
+
+	mux        sync.Mutex
+	proxy      string // 绑定的代理地址
+	exitIP     string // 绑定的代理的出口 IP
+	filter     string // 最后一次使用的 filter
+	expire     time.Time
+	generation int   // 轮换次数，参与哈希计算
+	used       int64 // 使用次数
+	failover   int64 // 由于代理不可用或者不满足 filter 切换的次数
+}
+
+// pick 返回会话绑定的代理，若绑定的代理已不可用或者不满足本次请求的 filter，
+// 优先选择出口 IP 相同的，否则按照会话 ID 确定性的选择一个新的
+func (s *stickySession) pick(active *ProxyList, filter string) (*proxyEntry, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.expire = time.Now().Add(getSessionTTL())
+	s.used++
+	s.filter = filter
+	if s.proxy != "" {
+		if one := active.Get(s.proxy); one != nil && !proxyBroken(one) && !proxySaturated(one) && matchFilter(one, filter) {
+			if ip := one.State.ExitIP.Load(); ip != "" {
+				s.exitIP = ip
+			}
+			return one, nil
+		}
+		s.failover++
+	}
+	return s.rebind(active, false)
+}
+
+// rebind 重新绑定代理，rotate 为 true 时尽量使用不同的代理和出口 IP，否则优先使用出口 IP 相同的
+func (s *stickySession) rebind(active *ProxyList, rotate bool) (*proxyEntry, error) {
+	list, err := active.Filter(s.filter)
+	if err != nil {
+		return nil, err
+	}
+	if rotate && s.proxy != "" {
+		list = preferProxies(list, func(p *proxyEntry) bool {
+			return p.Base.Proxy != s.proxy && (s.exitIP == "" || p.State.ExitIP.Load() != s.exitIP)
+		})
+		list = preferProxies(list, func(p *proxyEntry) bool {
+			return p.Base.Proxy != s.proxy
+		})
+	} else if s.exitIP != "" {
+		list = preferProxies(list, func(p *proxyEntry) bool {
+			return p.State.ExitIP.Load() == s.exitIP
+		})
+	}
+	one := rendezvousPick(list, s.Key+"#"+strconv.Itoa(s.generation))
+	s.proxy = one.Base.Proxy
+	s.exitIP = one.State.ExitIP.Load()
+	return one, nil
+}
+
+// preferProxies 返回满足条件的代理，都不满足时返回原列表
+func preferProxies(list []*proxyEntry, fn func(p *proxyEntry) bool) []*proxyEntry {
+	if !slices.ContainsFunc(list, fn) {
+		return list
+	}
+	if !slices.ContainsFunc(list, func(p *proxyEntry) bool { return !fn(p) }) {
+		return list
+	}
+	return slices.DeleteFunc(slices.Clone(list), func(p *proxyEntry) bool {
+		return !fn(p)
+	})
+}
+
+// Rotate 强制切换到另外一个代理
+func (s *stickySession) Rotate(active *ProxyList) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.generation++
+	_, err := s.rebind(active, true)
+	return err
+}
+
+func (s *stickySession) isExpired(now time.Time) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return now.After(s.expire)
+}
+
+// Info 用于管理页面展示
+func (s *stickySession) Info() map[string]any {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return map[string]any{
+		"Key":      s.Key,
+		"ID":       s.ID,
+		"User":     s.User,
+		"Proxy":    s.proxy,
+		"ExitIP":   s.exitIP,
+		"Filter":   s.filter,
+		"Created":  s.Created,
+		"Expire":   s.expire,
+		"Used":     s.used,
+		"Rotated":  s.generation,
+		"Failover": s.failover,
+	}
+}
+
+// rendezvousPick 最高随机权重哈希，对于同样的 key 和代理列表，总是返回同样的结果，
+// 并且代理列表变化时，只有绑定到变化代理上的会话才会切换
+func rendezvousPick(list []*proxyEntry, key string) *proxyEntry {
+	var best *proxyEntry
+	var bestScore uint64
+	for _, one := range list {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(one.Base.Proxy))
+		score := h.Sum64()
+		if best == nil || score > bestScore {
+			best = one
+			bestScore = score
+		}
+	}
+	return best
+}
+
+type sessionStore struct {
+	mux   sync.Mutex
+	items map[string]*stickySession
+}
+
+var sessions = &sessionStore{
+	items: make(map[string]*stickySession),
+}
+
+// Get 查找会话，不存在时创建
+func (ss *sessionStore) Get(user string, id string) *stickySession {
+	key := user + ":" + id
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if s, ok := ss.items[key]; ok && !s.isExpired(time.Now()) {
+		return s
+	}
+	s := &stickySession{
+		Key:     key,
+		ID:      id,
+		User:    user,
+		Created: time.Now(),
+		expire:  time.Now().Add(getSessionTTL()),
+	}
+	ss.items[key] = s
+	return s
+}
+
+func (ss *sessionStore) Lookup(key string) *stickySession {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	return ss.items[key]
+}
+
+func (ss *sessionStore) All() []*stickySession {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	result := make([]*stickySession, 0, len(ss.items))
+	for _, s := range ss.items {
+		result = append(result, s)
+	}
+	slices.SortFunc(result, func(a, b *stickySession) int {
+		return a.Created.Compare(b.Created)
+	})
+	return result
+}
+
+func (ss *sessionStore) Len() int {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	return len(ss.items)
+}
+
+// clean 清理已过期的会话
+func (ss *sessionStore) clean() {
+	now := time.Now()
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	for key, s := range ss.items {
+		if s.isExpired(now) {
+			delete(ss.items, key)
+		}
+	}
+}
+
+var ctxKeySession = xctx.NewKey()
+
+func contextWithSession(ctx context.Context, s *stickySession) context.Context {
+	return context.WithValue(ctx, ctxKeySession, s)
+}
+
+func sessionFromContext(ctx context.Context) *stickySession {
+	s, _ := ctx.Value(ctxKeySession).(*stickySession)
+	return s
+}
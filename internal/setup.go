@@ -2,14 +2,28 @@ package internal
 
 import (
 	"os"
+	"time"
 
+	"github.com/xanygo/anygo/safely"
 	"github.com/xanygo/anygo/xattr"
 	"github.com/xanygo/anygo/xlog"
 )
 
-func Setup() {
+func Setup(confPath string) {
+	appConfigFile = confPath
 	initLogger()
+	go safely.Run(events.sendWebhook)
+	geoIP.Reload()
+	SetInterval(geoIP.reloadIfChanged, time.Minute)
+	probes = loadProbes()
 	pool = loadPool()
+	routes = loadRouteTable()
+	banRules = loadBanRules()
+	SetInterval(reputation.clean, time.Minute)
+	SetInterval(sessions.clean, time.Minute)
+	traffic.load()
+	SetInterval(traffic.save, time.Minute)
+	SetInterval(cleanRequestLimits, time.Minute)
 }
 
 var version = "1.0.20260415"
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+)
+
+// stateFilePath 代理状态的快照文件，默认和 dyn.yml 在同一个目录
+func stateFilePath() string {
+	name := xattr.GetDefault[string]("StateFile", "proxy_state.json")
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(xattr.ConfDir(), name)
+	}
+	return name
+}
+
+// proxySnapshot 保存到快照文件中的代理状态
+type proxySnapshot struct {
+	LastCheck       time.Time     `json:"LastCheck"`
+	LastCheckOk     time.Time     `json:"LastCheckOk"`
+	LastCheckStatus int64         `json:"LastCheckStatus"`
+	LastCheckUsed   time.Duration `json:"LastCheckUsed"`
+	LastCheckMsg    string        `json:"LastCheckMsg,omitempty"`
+	CheckTimes      int64         `json:"CheckTimes"`
+	CheckFails      int64         `json:"CheckFails"`
+	Lifecycle       string        `json:"Lifecycle,omitempty"`
+	LifecycleSince  time.Time     `json:"LifecycleSince"`
+
+	UsedTotal   int64 `json:"UsedTotal"`
+	UsedSuccess int64 `json:"UsedSuccess"`
+	HedgeWin    int64 `json:"HedgeWin"`
+	HedgeLoss   int64 `json:"HedgeLoss"`
+
+	ExitIP    string        `json:"ExitIP,omitempty"`
+	Anonymity string        `json:"Anonymity,omitempty"`
+	Latency   time.Duration `json:"Latency"`
+	LastUsed  time.Time     `json:"LastUsed"`
+}
+
+type stateFile struct {
+	Time    time.Time                 `json:"Time"`
+	Proxies map[string]*proxySnapshot `json:"Proxies"`
+}
+
+func newProxySnapshot(ps *proxyState) *proxySnapshot {
+	return &proxySnapshot{
+		LastCheck:       ps.LastCheck.Load(),
+		LastCheckOk:     ps.LastCheckOk.Load(),
+		LastCheckStatus: ps.LastCheckStatus.Load(),
+		LastCheckUsed:   ps.LastCheckUsed.Load(),
+		LastCheckMsg:    ps.LastCheckMsg.Load(),
+		CheckTimes:      ps.CheckTimes.Load(),
+		CheckFails:      ps.CheckFails.Load(),
+		Lifecycle:       ps.Lifecycle.Load(),
+		LifecycleSince:  ps.LifecycleSince.Load(),
+		UsedTotal:       ps.UsedTotal.Load(),
+		UsedSuccess:     ps.UsedSuccess.Load(),
+		HedgeWin:        ps.HedgeWin.Load(),
+		HedgeLoss:       ps.HedgeLoss.Load(),
+		ExitIP:          ps.ExitIP.Load(),
+		Anonymity:       ps.Anonymity.Load(),
+		Latency:         ps.Latency.Load(),
+		LastUsed:        ps.LastUsed.Load(),
+	}
+}
+
+// restore 恢复代理的状态，之前可用的会优先检查
+func (s *proxySnapshot) restore(proxy *proxyEntry) {
+	ps := proxy.State
+	ps.LastCheck.Store(s.LastCheck)
+	ps.LastCheckOk.Store(s.LastCheckOk)
+	ps.LastCheckStatus.Store(s.LastCheckStatus)
+	ps.LastCheckUsed.Store(s.LastCheckUsed)
+	ps.LastCheckMsg.Store(s.LastCheckMsg)
+	ps.CheckTimes.Store(s.CheckTimes)
+	ps.CheckFails.Store(s.CheckFails)
+	ps.Lifecycle.Store(s.Lifecycle)
+	ps.LifecycleSince.Store(s.LifecycleSince)
+	ps.UsedTotal.Store(s.UsedTotal)
+	ps.UsedSuccess.Store(s.UsedSuccess)
+	ps.HedgeWin.Store(s.HedgeWin)
+	ps.HedgeLoss.Store(s.HedgeLoss)
+	ps.Anonymity.Store(s.Anonymity)
+	if s.Latency > 0 {
+		ps.Latency.Observe(s.Latency)
+	}
+	ps.LastUsed.Store(s.LastUsed)
+	if s.ExitIP != "" {
+		setExitIP(proxy, s.ExitIP)
+	}
+	updateAutoTags(proxy)
+	ps.Restored.Store(s.Lifecycle == stateActive)
+}
+
+// loadState 读取代理状态的快照，之前为 active 的代理先放入 active 中，并优先检查
+func (p *ProxyPool) loadState() {
+	p.loadStateFile(stateFilePath())
+}
+
+func (p *ProxyPool) loadStateFile(fp string) {
+	bf, err := os.ReadFile(fp)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("load proxy state failed:", err)
+		}
+		return
+	}
+	var data stateFile
+	if err = json.Unmarshal(bf, &data); err != nil {
+		log.Println("load proxy state failed:", fp, err)
+		return
+	}
+	var restored, active int
+	for _, one := range p.all.All() {
+		s := data.Proxies[one.Base.Proxy]
+		if s == nil {
+			continue
+		}
+		s.restore(one)
+		restored++
+		if one.LifecycleState() == stateActive {
+			p.active.Add(one)
+			active++
+		}
+	}
+	log.Printf("load proxy state success: %s, saved at %s, restored %d, active %d\n",
+		fp, data.Time.Format(timeFormatStd), restored, active)
+}
+
+// saveState 保存代理状态的快照，先写入临时文件再重命名
+func (p *ProxyPool) saveState() {
+	p.saveStateFile(stateFilePath())
+}
+
+func (p *ProxyPool) saveStateFile(fp string) {
+	data := stateFile{
+		Time:    time.Now(),
+		Proxies: make(map[string]*proxySnapshot),
+	}
+	for _, one := range p.all.All() {
+		data.Proxies[one.Base.Proxy] = newProxySnapshot(one.State)
+	}
+	bf, err := json.Marshal(data)
+	if err != nil {
+		log.Println("save proxy state failed:", err)
+		return
+	}
+	if err = writeFileAtomic(fp, bf); err != nil {
+		log.Println("save proxy state failed:", err)
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// setTestProxyState 设置需要保存到快照中的状态
+func setTestProxyState(p *proxyEntry, lifecycle string, now time.Time) {
+	ps := p.State
+	ps.LastCheck.Store(now)
+	ps.LastCheckOk.Store(now.Add(-time.Minute))
+	ps.LastCheckStatus.Store(200)
+	ps.LastCheckUsed.Store(150 * time.Millisecond)
+	ps.LastCheckMsg.Store("ok")
+	ps.CheckTimes.Store(10)
+	ps.CheckFails.Store(2)
+	ps.Lifecycle.Store(lifecycle)
+	ps.LifecycleSince.Store(now.Add(-time.Hour))
+	ps.UsedTotal.Store(100)
+	ps.UsedSuccess.Store(90)
+	ps.HedgeWin.Store(3)
+	ps.HedgeLoss.Store(4)
+	ps.ExitIP.Store("1.2.3.4")
+	ps.Anonymity.Store(anonymityElite)
+	ps.Latency.Observe(200 * time.Millisecond)
+	ps.LastUsed.Store(now.Add(-time.Second))
+}
+
+func snapshotJSON(t *testing.T, p *proxyEntry) string {
+	bf, err := json.Marshal(newProxySnapshot(p.State))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bf)
+}
+
+func TestProxySnapshotRestore(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		lifecycle    string
+		wantRestored bool
+	}{
+		{lifecycle: stateActive, wantRestored: true},
+		{lifecycle: stateQuarantined},
+	}
+	for i, tt := range tests {
+		t.Run(tt.lifecycle, func(t *testing.T) {
+			src := newCheckedProxy(100 + i)
+			setTestProxyState(src, tt.lifecycle, now)
+			want := snapshotJSON(t, src)
+
+			var s proxySnapshot
+			if err := json.Unmarshal([]byte(want), &s); err != nil {
+				t.Fatal(err)
+			}
+			dst := newProxy(src.Base.Proxy)
+			s.restore(dst)
+			if got := snapshotJSON(t, dst); got != want {
+				t.Fatalf("got  %s\nwant %s", got, want)
+			}
+			if dst.State.Restored.Load() != tt.wantRestored {
+				t.Fatalf("Restored=%v", dst.State.Restored.Load())
+			}
+			if !slices.Contains(dst.State.AutoTags.Load(), anonymityElite) {
+				t.Fatalf("AutoTags=%q", dst.State.AutoTags.Load())
+			}
+		})
+	}
+}
+
+func TestProxyPoolStateFile(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "proxy_state.json")
+	urls := []string{"http://127.0.0.1:201", "http://127.0.0.1:202", "http://127.0.0.1:203"}
+	newTestPool := func(urls ...string) *ProxyPool {
+		var items []*proxyBase
+		for _, u := range urls {
+			items = append(items, newProxy(u).Base)
+		}
+		return &ProxyPool{all: newProxyList(items), active: newProxyList(nil)}
+	}
+
+	now := time.Now().Truncate(time.Second)
+	src := newTestPool(urls...)
+	setTestProxyState(src.all.Get(urls[0]), stateActive, now)
+	setTestProxyState(src.all.Get(urls[1]), stateQuarantined, now)
+	src.saveStateFile(fp)
+
+	// 重启后 urls[2] 从配置中删除了，新增了一个
+	dst := newTestPool(urls[0], urls[1], "http://127.0.0.1:204")
+	dst.loadStateFile(fp)
+	for _, u := range urls[:2] {
+		if got, want := snapshotJSON(t, dst.all.Get(u)), snapshotJSON(t, src.all.Get(u)); got != want {
+			t.Fatalf("%s:\ngot  %s\nwant %s", u, got, want)
+		}
+	}
+	if dst.active.Total() != 1 || dst.active.Get(urls[0]) == nil {
+		t.Fatalf("active: %v", dst.active.All())
+	}
+	if fresh := dst.all.Get("http://127.0.0.1:204"); fresh.State.CheckTimes.Load() != 0 || fresh.LifecycleState() != stateNew {
+		t.Fatalf("new proxy should not be restored: %s", snapshotJSON(t, fresh))
+	}
+
+	// 文件不存在或者内容错误时忽略
+	for _, content := range []string{"", "{"} {
+		bad := filepath.Join(t.TempDir(), "bad.json")
+		if content != "" {
+			if err := os.WriteFile(bad, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p := newTestPool(urls...)
+		p.loadStateFile(bad)
+		if p.active.Total() != 0 || p.all.Get(urls[0]).State.CheckTimes.Load() != 0 {
+			t.Fatalf("content %q: state should not be restored", content)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/xanygo/anygo/xattr"
 	"github.com/xanygo/anygo/xhttp"
 	"github.com/xanygo/anygo/xhttp/xhandler"
 	"github.com/xanygo/anygo/xlog"
@@ -13,27 +12,40 @@ import (
 
 func Start() {
 	log.Println("starting...")
-	listen := xattr.AppMain().MustGetListen("main")
-	log.Println("start proxy manager at:", listen)
+	listeners := getListeners()
+	for _, lc := range listeners[1:] {
+		go startListener(lc)
+	}
+	startListener(listeners[0])
+}
+
+func startListener(lc *listenerConfig) {
+	log.Printf("start proxy manager at: %s (%s)\n", lc.Addr, lc.Name)
 
 	router := xhttp.NewRouter()
 	router.Use((&xhandler.AccessLog{
 		Logger: xlog.AccessLogger(),
 	}).Next)
 
-	router.Handle("*", &gateway{})
+	router.Handle("*", &gateway{listener: lc})
 
-	err := http.ListenAndServe(listen, router)
-	log.Println("proxy server exit:", err)
+	err := http.ListenAndServe(lc.Addr, router)
+	log.Printf("proxy server %s exit: %v\n", lc.Name, err)
 }
 
-type gateway struct{}
+type gateway struct {
+	listener *listenerConfig
+}
 
 func (gw *gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// bf, _ := httputil.DumpRequest(req, false)
 	// log.Println("ServeHTTP", req.Method, req.RequestURI, "request:\n", string(bf))
 
+	ctx := contextWithListener(req.Context(), gw.listener)
+	req = req.WithContext(ctx)
+
 	if strings.EqualFold(req.Method, http.MethodConnect) || strings.HasPrefix(req.RequestURI, "http://") {
+		xlog.AddAttr(ctx, xlog.String("Listener", gw.listener.Name))
 		defaultRelay.ServeHTTP(w, req)
 		return
 	}
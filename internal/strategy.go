@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xctx"
+	"github.com/xanygo/anygo/xattr"
+)
+
+// selectStrategy 代理的选择策略，从满足条件的代理中选择一个
+type selectStrategy interface {
+	Name() string
+
+	// Pick 从 list 中选择一个，list 不为空
+	Pick(ctx context.Context, list []*proxyEntry) *proxyEntry
+}
+
+// 内置的选择策略
+const (
+	strategyWeighted      = "weighted"       // 按照 Weight 加权随机，同时参考在目标域名上的成功率
+	strategyRoundRobin    = "round-robin"    // 轮询
+	strategyLeastInFlight = "least-inflight" // 进行中的请求数最少的
+	strategyLatency       = "latency"        // 延迟最低的，延迟为检查和转发的耗时的 EWMA
+	strategyLRU           = "lru"            // 最久未被使用的
+)
+
+var strategies = map[string]selectStrategy{
+	strategyWeighted:   weightedStrategy{},
+	strategyRoundRobin: &roundRobinStrategy{},
+	strategyLeastInFlight: minStrategy{name: strategyLeastInFlight, value: func(p *proxyEntry) float64 {
+		return float64(p.State.InFlight.Load())
+	}},
+	strategyLatency: latencyStrategy{},
+	strategyLRU: minStrategy{name: strategyLRU, value: func(p *proxyEntry) float64 {
+		return float64(p.State.LastUsed.Load().UnixNano())
+	}},
+}
+
+// getDefaultStrategy 全局的选择策略，app.yml 中的 SelectStrategy
+func getDefaultStrategy() string {
+	name := xattr.GetDefault[string]("SelectStrategy", "")
+	if _, ok := strategies[name]; ok {
+		return name
+	}
+	return strategyWeighted
+}
+
+// getStrategyWithRequest 选择策略，优先级：HTTP Header [X-Man-Strategy] > 代理用户名 > 监听端口 > 全局
+// 无效的名称会被忽略
+func getStrategyWithRequest(req *http.Request, user *User) selectStrategy {
+	names := []string{req.Header.Get("X-Man-Strategy")}
+	if user != nil {
+		names = append(names, user.Options.Strategy)
+	}
+	names = append(names, listenerFromContext(req.Context()).Strategy, getDefaultStrategy())
+	for _, name := range names {
+		if s, ok := getStrategy(name); ok {
+			return s
+		}
+	}
+	return strategies[strategyWeighted]
+}
+
+// getStrategy 按照名称查找选择策略，不区分大小写
+func getStrategy(name string) (selectStrategy, bool) {
+	s, ok := strategies[strings.ToLower(strings.TrimSpace(name))]
+	return s, ok
+}
+
+var ctxKeyStrategy = xctx.NewKey()
+
+func contextWithStrategy(ctx context.Context, s selectStrategy) context.Context {
+	return context.WithValue(ctx, ctxKeyStrategy, s)
+}
+
+// strategyFromContext 请求使用的选择策略，没有时使用监听端口或者全局的
+func strategyFromContext(ctx context.Context) selectStrategy {
+	if s, ok := ctx.Value(ctxKeyStrategy).(selectStrategy); ok {
+		return s
+	}
+	if s, ok := getStrategy(listenerFromContext(ctx).Strategy); ok {
+		return s
+	}
+	return strategies[getDefaultStrategy()]
+}
+
+// weightedStrategy 按照 Weight 加权随机，Weight 小于等于 0 时按照 1 处理，
+// 权重会乘以代理在目标域名上的成功率
+type weightedStrategy struct{}
+
+func (weightedStrategy) Name() string {
+	return strategyWeighted
+}
+
+func (weightedStrategy) Pick(ctx context.Context, list []*proxyEntry) *proxyEntry {
+	if len(list) == 1 {
+		return list[0]
+	}
+	scores, _ := reputation.scores(targetDomainFromContext(ctx), list)
+	var total float64
+	for i, p := range list {
+		// 成功率低的仍保留一定的机会，使其可以恢复
+		scores[i] = float64(max(p.Base.Weight, 1)) * max(scores[i], 0.05)
+		total += scores[i]
+	}
+	n := rand.Float64() * total
+	for i, s := range scores {
+		n -= s
+		if n < 0 {
+			return list[i]
+		}
+	}
+	return list[len(list)-1]
+}
+
+// roundRobinStrategy 按照顺序依次选择
+type roundRobinStrategy struct {
+	next atomic.Int64
+}
+
+func (s *roundRobinStrategy) Name() string {
+	return strategyRoundRobin
+}
+
+func (s *roundRobinStrategy) Pick(_ context.Context, list []*proxyEntry) *proxyEntry {
+	return nextOf(&s.next, list)
+}
+
+// minStrategy 选择 value 最小的，有多个时随机选择一个
+type minStrategy struct {
+	name  string
+	value func(p *proxyEntry) float64
+}
+
+func (s minStrategy) Name() string {
+	return s.name
+}
+
+func (s minStrategy) Pick(_ context.Context, list []*proxyEntry) *proxyEntry {
+	return pickMin(list, s.value)
+}
+
+// latencyStrategy 选择延迟最低的，还没有延迟数据的按照平均值处理
+type latencyStrategy struct{}
+
+func (latencyStrategy) Name() string {
+	return strategyLatency
+}
+
+func (latencyStrategy) Pick(_ context.Context, list []*proxyEntry) *proxyEntry {
+	var sum time.Duration
+	var known int
+	for _, p := range list {
+		if v := p.State.Latency.Load(); v > 0 {
+			sum += v
+			known++
+		}
+	}
+	var avg float64
+	if known > 0 {
+		avg = float64(sum) / float64(known)
+	}
+	return pickMin(list, func(p *proxyEntry) float64 {
+		if v := p.State.Latency.Load(); v > 0 {
+			return float64(v)
+		}
+		return avg
+	})
+}
+
+func pickMin(list []*proxyEntry, value func(p *proxyEntry) float64) *proxyEntry {
+	var result *proxyEntry
+	var minValue float64
+	var same int
+	for _, p := range list {
+		v := value(p)
+		switch {
+		case result == nil || v < minValue:
+			result, minValue, same = p, v, 1
+		case v == minValue:
+			// 蓄水池抽样，使值相同的被选中的概率相同
+			same++
+			if rand.IntN(same) == 0 {
+				result = p
+			}
+		}
+	}
+	return result
+}
+
+// ewmaDuration 耗时的指数加权移动平均值
+type ewmaDuration struct {
+	v atomic.Int64
+}
+
+// ewmaAlpha 新的值所占的权重
+const ewmaAlpha = 0.3
+
+func (e *ewmaDuration) Observe(d time.Duration) {
+	for {
+		old := e.v.Load()
+		val := int64(d)
+		if old > 0 {
+			val = int64(ewmaAlpha*float64(d) + (1-ewmaAlpha)*float64(old))
+		}
+		if e.v.CompareAndSwap(old, val) {
+			return
+		}
+	}
+}
+
+func (e *ewmaDuration) Load() time.Duration {
+	return time.Duration(e.v.Load())
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pickCounts 选择 n 次，返回每个代理被选中的次数
+func pickCounts(ctx context.Context, s selectStrategy, list []*proxyEntry, n int) map[*proxyEntry]int {
+	counts := make(map[*proxyEntry]int, len(list))
+	for range n {
+		counts[s.Pick(ctx, list)]++
+	}
+	return counts
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	setTestAppConfig(t, &appConfig{})
+	old := reputation
+	reputation = &reputationStore{domains: make(map[string]map[string]*reputationScore)}
+	t.Cleanup(func() {
+		reputation = old
+	})
+
+	newWeighted := func(id int, weight int) *proxyEntry {
+		p := newCheckedProxy(id)
+		p.Base.Weight = weight
+		return p
+	}
+	const n = 20000
+	tests := []struct {
+		name    string
+		weights []int
+		failed  []int     // 在 example.com 上失败 20 次的代理的下标，其他的成功 20 次
+		want    []float64 // 每个代理被选中的比例
+	}{
+		{name: "same weight", weights: []int{1, 1}, want: []float64{0.5, 0.5}},
+		{name: "by weight", weights: []int{1, 3}, want: []float64{0.25, 0.75}},
+		{name: "zero weight as 1", weights: []int{0, -1, 2}, want: []float64{0.25, 0.25, 0.5}},
+		// 成功率 21/22 和 1/22（按照 0.05 处理）
+		{name: "by reputation", weights: []int{1, 1}, failed: []int{1}, want: []float64{0.95, 0.05}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reputation.domains = make(map[string]map[string]*reputationScore)
+			ctx := contextWithTargetHost(context.Background(), "example.com")
+			var list []*proxyEntry
+			for i, w := range tt.weights {
+				p := newWeighted(i, w)
+				list = append(list, p)
+				ok := !slices.Contains(tt.failed, i)
+				for range 20 {
+					reputation.record(ctx, p, ok)
+				}
+			}
+			if len(tt.failed) == 0 {
+				ctx = context.Background()
+			}
+			counts := pickCounts(ctx, weightedStrategy{}, list, n)
+			var ratios []float64
+			for i, p := range list {
+				ratio := float64(counts[p]) / n
+				ratios = append(ratios, ratio)
+				if ratio < tt.want[i]-0.03 || ratio > tt.want[i]+0.03 {
+					t.Fatalf("ratios=%.3f, want %v", ratios, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMinStrategies(t *testing.T) {
+	a, b, c := newCheckedProxy(1), newCheckedProxy(2), newCheckedProxy(3)
+	list := []*proxyEntry{a, b, c}
+	now := time.Now()
+
+	a.State.InFlight.Store(3)
+	b.State.InFlight.Store(1)
+	c.State.InFlight.Store(2)
+	a.State.LastUsed.Store(now)
+	b.State.LastUsed.Store(now.Add(-time.Minute))
+	c.State.LastUsed.Store(now.Add(-time.Hour))
+	a.State.Latency.Observe(300 * time.Millisecond)
+	b.State.Latency.Observe(100 * time.Millisecond)
+
+	tests := []struct {
+		strategy string
+		want     *proxyEntry
+	}{
+		{strategy: strategyLeastInFlight, want: b},
+		{strategy: strategyLRU, want: c},
+		// c 没有延迟数据，按照平均值 200ms 处理
+		{strategy: strategyLatency, want: b},
+	}
+	for _, tt := range tests {
+		s, ok := getStrategy(tt.strategy)
+		if !ok {
+			t.Fatalf("strategy %q not found", tt.strategy)
+		}
+		if got := s.Pick(context.Background(), list); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.strategy, got.Base.Proxy, tt.want.Base.Proxy)
+		}
+	}
+
+	// 值相同的随机选择
+	b.State.InFlight.Store(2)
+	counts := pickCounts(context.Background(), strategies[strategyLeastInFlight], list, 1000)
+	if counts[a] != 0 || counts[b] < 400 || counts[c] < 400 {
+		t.Fatalf("got %v", counts)
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	list := []*proxyEntry{newCheckedProxy(1), newCheckedProxy(2), newCheckedProxy(3)}
+	s := &roundRobinStrategy{}
+	for i := range 7 {
+		if got := s.Pick(context.Background(), list); got != list[i%3] {
+			t.Fatalf("pick %d: got %s", i, got.Base.Proxy)
+		}
+	}
+	if _, ok := getStrategy(" Round-Robin "); !ok {
+		t.Fatal("getStrategy should ignore case and spaces")
+	}
+	if _, ok := getStrategy("nosuch"); ok {
+		t.Fatal("getStrategy(nosuch) should fail")
+	}
+}
+
+func TestEWMADuration(t *testing.T) {
+	var e ewmaDuration
+	e.Observe(100 * time.Millisecond)
+	if e.Load() != 100*time.Millisecond {
+		t.Fatalf("first Observe: got %s", e.Load())
+	}
+	e.Observe(200 * time.Millisecond)
+	if e.Load() != 130*time.Millisecond {
+		t.Fatalf("got %s, want 130ms", e.Load())
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// filterTier 分层筛选中的一层，如 tier1=dc; tier2=residential; tier3=direct ，
+// 前一层的重试次数用完后，才使用下一层
+type filterTier struct {
+	Name   string // 名称，如 tier1，不分层时为空
+	Filter string // 筛选条件，格式同 X-Man-Filter
+	Direct bool   // 筛选条件为 direct 时，不使用代理直接访问
+}
+
+// pick 选择这一层的一个代理
+func (t filterTier) pick(ctx context.Context) (*proxyEntry, error) {
+	if t.Direct {
+		return directEntry, nil
+	}
+	return pool.getOneProxyActive(ctx, t.Filter)
+}
+
+type filterTiers []filterTier
+
+// isTieredFilter 是否分层的筛选条件，多层之间使用 ; 分隔，只有一层时可以以 ; 结尾，如 tier1=dc;
+func isTieredFilter(filter string) bool {
+	return strings.Contains(filter, ";")
+}
+
+// parseFilterTiers 解析分层的筛选条件，每一层的格式为 名称=筛选条件
+func parseFilterTiers(filter string) (filterTiers, error) {
+	var tiers filterTiers
+	for _, part := range strings.Split(filter, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, sub, ok := strings.Cut(part, "=")
+		name, sub = strings.TrimSpace(name), strings.TrimSpace(sub)
+		if !ok || name == "" || strings.IndexFunc(name, func(r rune) bool { return r > unicode.MaxASCII || !isFilterWordChar(byte(r)) }) >= 0 {
+			return nil, &filterError{Filter: filter, Msg: fmt.Sprintf("invalid tier %q, expected name=filter", part)}
+		}
+		if slices.ContainsFunc(tiers, func(t filterTier) bool { return t.Name == name }) {
+			return nil, &filterError{Filter: filter, Msg: fmt.Sprintf("duplicate tier %q", name)}
+		}
+		tier := filterTier{Name: name, Filter: sub, Direct: strings.EqualFold(sub, "direct")}
+		if !tier.Direct {
+			if err := checkFilter(sub); err != nil {
+				return nil, fmt.Errorf("tier %q: %w", name, err)
+			}
+		}
+		tiers = append(tiers, tier)
+	}
+	if len(tiers) == 0 {
+		return nil, &filterError{Filter: filter, Msg: "no tier"}
+	}
+	return tiers, nil
+}
+
+// filter 依次使用每一层（不包括 direct）筛选，返回第一个有结果的
+func (ts filterTiers) filter(all []*proxyEntry) []*proxyEntry {
+	for _, t := range ts {
+		if t.Direct {
+			continue
+		}
+		fn, err := buildFilter(t.Filter)
+		if err != nil {
+			continue
+		}
+		if result := fn(all); len(result) > 0 {
+			return result
+		}
+	}
+	return nil
+}
+
+// total 总的尝试次数，每一层都尝试 attempt 次
+func (ts filterTiers) total(attempt int) int {
+	return attempt * len(ts)
+}
+
+// at 第 i 次尝试（从 0 开始）使用的层
+func (ts filterTiers) at(i int, attempt int) filterTier {
+	return ts[i/attempt]
+}
+
+// skip 当前层没有可用的代理时，跳过这一层剩余的尝试，返回这一层最后一次尝试的序号
+func (ts filterTiers) skip(i int, attempt int) int {
+	return (i/attempt+1)*attempt - 1
+}
+
+// getFilterTiers 返回筛选条件的每一层，不分层时只有一层，名称为空
+func getFilterTiers(filter string) filterTiers {
+	if c := loadFilter(filter); c.tiers != nil {
+		return c.tiers
+	}
+	return filterTiers{{Filter: filter}}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestGetFilterTiers(t *testing.T) {
+	ts := getFilterTiers("tier1=dc; tier2 = us&residential ;tier3=direct")
+	want := filterTiers{
+		{Name: "tier1", Filter: "dc"},
+		{Name: "tier2", Filter: "us&residential"},
+		{Name: "tier3", Filter: "direct", Direct: true},
+	}
+	if !slices.Equal(ts, want) {
+		t.Fatalf("got %+v, want %+v", ts, want)
+	}
+	if ts := getFilterTiers("tier1=tag:dc;"); !slices.Equal(ts, filterTiers{{Name: "tier1", Filter: "tag:dc"}}) {
+		t.Fatalf("got %+v", ts)
+	}
+	if ts := getFilterTiers("dc"); !slices.Equal(ts, filterTiers{{Filter: "dc"}}) {
+		t.Fatalf("got %+v", ts)
+	}
+
+	for _, filter := range []string{";", "dc;", "=dc;", "t1=dc;t1=de", "t 1=dc;", "t1=(tag:dc;"} {
+		if err := checkFilter(filter); err == nil {
+			t.Errorf("checkFilter(%q) expect error", filter)
+		}
+	}
+}
+
+func TestFilterTiersFilter(t *testing.T) {
+	all := newFilterTestProxies(t)
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{filter: "t1=residential; t2=dc", want: "a"},
+		{filter: "t1=nosuch; t2=tag:de", want: "c"},
+		{filter: "t1=direct; t2=dc", want: "bc"},
+		{filter: "t1=nosuch; t2=direct", want: ""},
+	}
+	for _, tt := range tests {
+		fn, err := buildFilter(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filterNames(fn(all), all); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+// tierAttempts 模拟 relay 中的重试循环，返回每次实际尝试的 层#序号，empty 中的层没有可用的代理
+func tierAttempts(ts filterTiers, attempt int, empty ...string) []string {
+	var tried []string
+	total := ts.total(attempt)
+	for i := 0; i < total; i++ {
+		tier := ts.at(i, attempt)
+		if slices.Contains(empty, tier.Name) {
+			i = ts.skip(i, attempt)
+			continue
+		}
+		tried = append(tried, tier.Name+"#"+strconv.Itoa(i))
+	}
+	return tried
+}
+
+func TestFilterTiersAttempts(t *testing.T) {
+	three := filterTiers{{Name: "t1"}, {Name: "t2"}, {Name: "t3"}}
+	tests := []struct {
+		name    string
+		tiers   filterTiers
+		attempt int
+		empty   []string
+		want    []string
+	}{
+		{name: "no tier", tiers: filterTiers{{}}, attempt: 3, want: []string{"#0", "#1", "#2"}},
+		{name: "attempt 1 < 3 tiers", tiers: three, attempt: 1, want: []string{"t1#0", "t2#1", "t3#2"}},
+		{name: "attempt 2 < 3 tiers", tiers: three, attempt: 2, want: []string{"t1#0", "t1#1", "t2#2", "t2#3", "t3#4", "t3#5"}},
+		{name: "attempt 4 > 2 tiers", tiers: filterTiers{{Name: "t1"}, {Name: "t2"}}, attempt: 4,
+			want: []string{"t1#0", "t1#1", "t1#2", "t1#3", "t2#4", "t2#5", "t2#6", "t2#7"}},
+
+		{name: "first empty", tiers: three, attempt: 2, empty: []string{"t1"}, want: []string{"t2#2", "t2#3", "t3#4", "t3#5"}},
+		{name: "middle empty", tiers: three, attempt: 2, empty: []string{"t2"}, want: []string{"t1#0", "t1#1", "t3#4", "t3#5"}},
+		{name: "last empty", tiers: three, attempt: 2, empty: []string{"t3"}, want: []string{"t1#0", "t1#1", "t2#2", "t2#3"}},
+		{name: "attempt 1 middle empty", tiers: three, attempt: 1, empty: []string{"t2"}, want: []string{"t1#0", "t3#2"}},
+		{name: "attempt 1 two empty", tiers: three, attempt: 1, empty: []string{"t1", "t2"}, want: []string{"t3#2"}},
+		{name: "all empty", tiers: three, attempt: 3, empty: []string{"t1", "t2", "t3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tierAttempts(tt.tiers, tt.attempt, tt.empty...)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xio/xfs"
+)
+
+// 流量统计的分组
+const (
+	trafficGroupUser     = "user"
+	trafficGroupProxy    = "proxy"
+	trafficGroupDomain   = "domain"
+	trafficGroupListener = "listener"
+	trafficGroupTier     = "tier" // 分层筛选中实际使用的层，见 filterTier
+)
+
+var trafficGroups = []string{trafficGroupUser, trafficGroupProxy, trafficGroupDomain, trafficGroupListener, trafficGroupTier}
+
+const (
+	// 每个分组最多统计的数量，超过后计入 trafficOtherKey，避免域名过多时内存无限增长
+	trafficMaxKeys  = 5000
+	trafficOtherKey = "(other)"
+
+	// 超过此时间未使用的域名统计会被清理
+	trafficDomainTTL = 7 * 24 * time.Hour
+)
+
+func trafficFilePath() string {
+	name := xattr.GetDefault[string]("TrafficFile", "traffic.json")
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(xattr.ConfDir(), name)
+	}
+	return name
+}
+
+// trafficBucket 一个时间片内的流量
+type trafficBucket struct {
+	Slot int64 `json:"s"` // Unix 时间 / 时间片长度
+	Up   int64 `json:"u"`
+	Down int64 `json:"d"`
+}
+
+// trafficWindow 滑动窗口：固定数量的时间片，循环使用
+type trafficWindow struct {
+	Width   int64 // 时间片长度，单位秒
+	Buckets []trafficBucket
+}
+
+func newTrafficWindow(width time.Duration, num int) trafficWindow {
+	return trafficWindow{
+		Width:   int64(width / time.Second),
+		Buckets: make([]trafficBucket, num),
+	}
+}
+
+type trafficWindowJSON struct {
+	Width   int64           `json:"Width"`
+	Size    int             `json:"Size"`
+	Buckets []trafficBucket `json:"Buckets"` // 只保存有数据的时间片
+}
+
+func (w trafficWindow) MarshalJSON() ([]byte, error) {
+	data := trafficWindowJSON{Width: w.Width, Size: len(w.Buckets)}
+	for _, b := range w.Buckets {
+		if b.Slot != 0 {
+			data.Buckets = append(data.Buckets, b)
+		}
+	}
+	return json.Marshal(data)
+}
+
+func (w *trafficWindow) UnmarshalJSON(bf []byte) error {
+	var data trafficWindowJSON
+	if err := json.Unmarshal(bf, &data); err != nil {
+		return err
+	}
+	if data.Width <= 0 || data.Size <= 0 {
+		return errors.New("invalid traffic window")
+	}
+	w.Width = data.Width
+	w.Buckets = make([]trafficBucket, data.Size)
+	for _, b := range data.Buckets {
+		w.Buckets[b.Slot%int64(data.Size)] = b
+	}
+	return nil
+}
+
+func (w *trafficWindow) add(now int64, up int64, down int64) {
+	slot := now / w.Width
+	b := &w.Buckets[slot%int64(len(w.Buckets))]
+	if b.Slot != slot {
+		*b = trafficBucket{Slot: slot}
+	}
+	b.Up += up
+	b.Down += down
+}
+
+func (w *trafficWindow) sum(now int64) (up int64, down int64) {
+	minSlot := now/w.Width - int64(len(w.Buckets)) + 1
+	for _, b := range w.Buckets {
+		if b.Slot >= minSlot {
+			up += b.Up
+			down += b.Down
+		}
+	}
+	return up, down
+}
+
+// trafficCounter 一个用户/代理/域名/监听端口的流量，Up 为上行（客户端发往目标），Down 为下行
+type trafficCounter struct {
+	mux      sync.Mutex
+	Up       int64         `json:"Up"`
+	Down     int64         `json:"Down"`
+	Minutes  trafficWindow `json:"Minutes"` // 最近 1 小时，每分钟一个时间片
+	Hours    trafficWindow `json:"Hours"`   // 最近 24 小时，每小时一个时间片
+	LastUsed time.Time     `json:"LastUsed"`
+
+	// 自然日和自然月的流量，用于流量配额
+	Day       string `json:"Day"` // 如 2026-01-02
+	DayUp     int64  `json:"DayUp"`
+	DayDown   int64  `json:"DayDown"`
+	Month     string `json:"Month"` // 如 2026-01
+	MonthUp   int64  `json:"MonthUp"`
+	MonthDown int64  `json:"MonthDown"`
+}
+
+func newTrafficCounter() *trafficCounter {
+	return &trafficCounter{
+		Minutes: newTrafficWindow(time.Minute, 60),
+		Hours:   newTrafficWindow(time.Hour, 24),
+	}
+}
+
+func (tc *trafficCounter) add(now time.Time, up int64, down int64) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.Up += up
+	tc.Down += down
+	tc.Minutes.add(now.Unix(), up, down)
+	tc.Hours.add(now.Unix(), up, down)
+	tc.LastUsed = now
+
+	if day := now.Format(time.DateOnly); tc.Day != day {
+		tc.Day, tc.DayUp, tc.DayDown = day, 0, 0
+	}
+	tc.DayUp += up
+	tc.DayDown += down
+	if month := now.Format("2006-01"); tc.Month != month {
+		tc.Month, tc.MonthUp, tc.MonthDown = month, 0, 0
+	}
+	tc.MonthUp += up
+	tc.MonthDown += down
+}
+
+// trafficItem 用于展示的流量统计
+type trafficItem struct {
+	Key      string
+	Up       int64
+	Down     int64
+	Up1h     int64
+	Down1h   int64
+	Up24h    int64
+	Down24h  int64
+	LastUsed time.Time
+
+	DayUp     int64 // 今天
+	DayDown   int64
+	MonthUp   int64 // 本月
+	MonthDown int64
+}
+
+func (it trafficItem) Total() int64 {
+	return it.Up + it.Down
+}
+
+func (it trafficItem) Total24h() int64 {
+	return it.Up24h + it.Down24h
+}
+
+func (it trafficItem) DayTotal() int64 {
+	return it.DayUp + it.DayDown
+}
+
+func (it trafficItem) MonthTotal() int64 {
+	return it.MonthUp + it.MonthDown
+}
+
+func (tc *trafficCounter) item(key string, now time.Time) trafficItem {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	it := trafficItem{
+		Key:      key,
+		Up:       tc.Up,
+		Down:     tc.Down,
+		LastUsed: tc.LastUsed,
+	}
+	it.Up1h, it.Down1h = tc.Minutes.sum(now.Unix())
+	it.Up24h, it.Down24h = tc.Hours.sum(now.Unix())
+	if tc.Day == now.Format(time.DateOnly) {
+		it.DayUp, it.DayDown = tc.DayUp, tc.DayDown
+	}
+	if tc.Month == now.Format("2006-01") {
+		it.MonthUp, it.MonthDown = tc.MonthUp, tc.MonthDown
+	}
+	return it
+}
+
+// trafficKey 一次请求或者隧道的流量归属
+type trafficKey struct {
+	User     string
+	Proxy    string
+	Domain   string
+	Listener string
+	Tier     string
+}
+
+// newTrafficKey 从 ctx 中读取监听端口
+func newTrafficKey(ctx context.Context, user string, proxy *proxyEntry, domain string) trafficKey {
+	tk := trafficKey{
+		User:     user,
+		Domain:   domain,
+		Listener: listenerFromContext(ctx).Name,
+	}
+	if proxy != nil {
+		tk.Proxy = proxy.Base.Proxy
+	}
+	return tk
+}
+
+// trafficStats 流量统计，定期保存到文件，重启后继续累计
+type trafficStats struct {
+	mux    sync.Mutex
+	groups map[string]map[string]*trafficCounter
+}
+
+var traffic = newTrafficStats()
+
+func newTrafficStats() *trafficStats {
+	ts := &trafficStats{
+		groups: make(map[string]map[string]*trafficCounter, len(trafficGroups)),
+	}
+	for _, g := range trafficGroups {
+		ts.groups[g] = make(map[string]*trafficCounter)
+	}
+	return ts
+}
+
+func (ts *trafficStats) counter(group string, key string) *trafficCounter {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	items := ts.groups[group]
+	if tc, ok := items[key]; ok {
+		return tc
+	}
+	if len(items) >= trafficMaxKeys {
+		key = trafficOtherKey
+		if tc, ok := items[key]; ok {
+			return tc
+		}
+	}
+	tc := newTrafficCounter()
+	items[key] = tc
+	return tc
+}
+
+// Add 记录流量，up 为上行字节数，down 为下行字节数
+func (ts *trafficStats) Add(tk trafficKey, up int64, down int64) {
+	if up <= 0 && down <= 0 {
+		return
+	}
+	now := time.Now()
+	ts.counter(trafficGroupUser, trafficUserKey(tk.User)).add(now, up, down)
+	ts.counter(trafficGroupListener, tk.Listener).add(now, up, down)
+	if tk.Proxy != "" {
+		ts.counter(trafficGroupProxy, tk.Proxy).add(now, up, down)
+	}
+	if tk.Domain != "" {
+		ts.counter(trafficGroupDomain, tk.Domain).add(now, up, down)
+	}
+	if tk.Tier != "" {
+		ts.counter(trafficGroupTier, tk.Tier).add(now, up, down)
+	}
+}
+
+func trafficUserKey(name string) string {
+	if name == "" {
+		return "(anonymous)"
+	}
+	return name
+}
+
+// Get 返回一项的流量，不存在时返回空的
+func (ts *trafficStats) Get(group string, key string) trafficItem {
+	ts.mux.Lock()
+	tc := ts.groups[group][key]
+	ts.mux.Unlock()
+	if tc == nil {
+		return trafficItem{Key: key}
+	}
+	return tc.item(key, time.Now())
+}
+
+// List 返回一个分组的流量，按照最近 24 小时的流量降序，limit<=0 时返回全部
+func (ts *trafficStats) List(group string, limit int) []trafficItem {
+	ts.mux.Lock()
+	counters := make(map[string]*trafficCounter, len(ts.groups[group]))
+	for k, v := range ts.groups[group] {
+		counters[k] = v
+	}
+	ts.mux.Unlock()
+
+	now := time.Now()
+	result := make([]trafficItem, 0, len(counters))
+	for k, tc := range counters {
+		result = append(result, tc.item(k, now))
+	}
+	slices.SortFunc(result, func(a, b trafficItem) int {
+		if c := cmp.Compare(b.Total24h(), a.Total24h()); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Total(), a.Total()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// load 读取保存的统计数据
+func (ts *trafficStats) load() {
+	fp := trafficFilePath()
+	bf, err := os.ReadFile(fp)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("load traffic stats failed:", err)
+		}
+		return
+	}
+	var data map[string]map[string]*trafficCounter
+	if err = json.Unmarshal(bf, &data); err != nil {
+		log.Println("load traffic stats failed:", fp, err)
+		return
+	}
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	for _, g := range trafficGroups {
+		for k, tc := range data[g] {
+			if tc == nil || len(tc.Minutes.Buckets) == 0 || len(tc.Hours.Buckets) == 0 {
+				continue
+			}
+			ts.groups[g][k] = tc
+		}
+	}
+	log.Println("load traffic stats success:", fp)
+}
+
+// save 保存统计数据，先写入临时文件再重命名，避免写入过程中退出导致文件损坏
+func (ts *trafficStats) save() {
+	ts.clean()
+	ts.mux.Lock()
+	data := make(map[string]map[string]*trafficCounter, len(ts.groups))
+	var locked []*trafficCounter
+	for g, items := range ts.groups {
+		data[g] = make(map[string]*trafficCounter, len(items))
+		for k, tc := range items {
+			tc.mux.Lock()
+			locked = append(locked, tc)
+			data[g][k] = tc
+		}
+	}
+	bf, err := json.Marshal(data)
+	for _, tc := range locked {
+		tc.mux.Unlock()
+	}
+	ts.mux.Unlock()
+	if err != nil {
+		log.Println("save traffic stats failed:", err)
+		return
+	}
+	if err = writeFileAtomic(trafficFilePath(), bf); err != nil {
+		log.Println("save traffic stats failed:", err)
+	}
+}
+
+// clean 清理长时间未使用的域名
+func (ts *trafficStats) clean() {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	for k, tc := range ts.groups[trafficGroupDomain] {
+		tc.mux.Lock()
+		expired := time.Since(tc.LastUsed) > trafficDomainTTL
+		tc.mux.Unlock()
+		if expired {
+			delete(ts.groups[trafficGroupDomain], k)
+		}
+	}
+}
+
+// writeFileAtomic 先写入同目录的临时文件，再重命名为目标文件
+func writeFileAtomic(filename string, content []byte) error {
+	dir := filepath.Dir(filename)
+	xfs.KeepDirExists(dir)
+	f, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
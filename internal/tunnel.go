@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xattr"
+	"github.com/xanygo/anygo/xlog"
+)
+
+// tunnelTimeoutConfig CONNECT 隧道的超时配置，单位秒，可以在 app.yml 中全局配置，
+// 也可以在 Listeners 和 users.yml 中配置，优先级：用户 > 监听端口 > 全局
+type tunnelTimeoutConfig struct {
+	TunnelConnectTimeout int `yaml:"TunnelConnectTimeout"` // 连接代理服务器和目标地址的超时
+	TunnelIdleTimeout    int `yaml:"TunnelIdleTimeout"`    // 双向都没有数据传输的超时
+	TunnelMaxLifetime    int `yaml:"TunnelMaxLifetime"`    // 隧道最长存活时间，0 为不限制
+}
+
+// tunnelTimeouts 生效的超时配置
+type tunnelTimeouts struct {
+	Connect     time.Duration
+	Idle        time.Duration
+	MaxLifetime time.Duration
+}
+
+func (tt *tunnelTimeouts) merge(cfg tunnelTimeoutConfig) {
+	if cfg.TunnelConnectTimeout > 0 {
+		tt.Connect = time.Duration(cfg.TunnelConnectTimeout) * time.Second
+	}
+	if cfg.TunnelIdleTimeout > 0 {
+		tt.Idle = time.Duration(cfg.TunnelIdleTimeout) * time.Second
+	}
+	if cfg.TunnelMaxLifetime > 0 {
+		tt.MaxLifetime = time.Duration(cfg.TunnelMaxLifetime) * time.Second
+	}
+}
+
+// getTunnelTimeouts 返回请求生效的隧道超时配置
+func getTunnelTimeouts(ctx context.Context, user *User) tunnelTimeouts {
+	tt := tunnelTimeouts{
+		Connect: getProxyTimeout(),
+		Idle:    300 * time.Second,
+	}
+	tt.merge(tunnelTimeoutConfig{
+		TunnelConnectTimeout: xattr.GetDefault[int]("TunnelConnectTimeout", 0),
+		TunnelIdleTimeout:    xattr.GetDefault[int]("TunnelIdleTimeout", 0),
+		TunnelMaxLifetime:    xattr.GetDefault[int]("TunnelMaxLifetime", 0),
+	})
+	tt.merge(listenerFromContext(ctx).tunnelTimeoutConfig)
+	if user != nil {
+		if u := getUser(user.Name); u != nil {
+			tt.merge(u.tunnelTimeoutConfig)
+		}
+	}
+	return tt
+}
+
+// 隧道关闭的原因
+const (
+	tunnelCloseClient      = "client closed"
+	tunnelCloseIdle        = "idle timeout"
+	tunnelCloseMaxLifetime = "max lifetime"
+	tunnelCloseCanceled    = "canceled"
+)
+
+// deadlineConn 支持设置超时的连接，如 net.Conn
+type deadlineConn interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+func setReadDeadline(c io.ReadWriteCloser, t time.Time) {
+	if dc, ok := c.(deadlineConn); ok {
+		dc.SetReadDeadline(t)
+	}
+}
+
+func setWriteDeadline(c io.ReadWriteCloser, t time.Time) {
+	if dc, ok := c.(deadlineConn); ok {
+		dc.SetWriteDeadline(t)
+	}
+}
+
+// tunnel 在客户端和代理服务器的连接之间双向的转发数据。
+// 连接不支持设置超时时（如协议升级后上游的 Body），依靠另外一个方向的读超时检查空闲
+type tunnel struct {
+	client   io.ReadWriteCloser
+	server   io.ReadWriteCloser
+	timeouts tunnelTimeouts
+
+	lastActive atomic.Int64 // 最后一次传输数据的时间，UnixNano
+
+	closeOnce sync.Once
+	reason    string
+
+	up   int64 // 客户端发往服务端的字节数
+	down int64 // 服务端发往客户端的字节数
+
+	upLimit   *tokenBucket // 上行限速，为 nil 时不限速
+	downLimit *tokenBucket // 下行限速，为 nil 时不限速
+
+	// 每次转发数据后调用，用于流量统计，返回错误时关闭隧道（如超过流量配额）
+	account func(up int64, down int64) error
+
+	done chan struct{} // 关闭后 close
+}
+
+// close 关闭两端的连接，只记录第一次的原因
+func (t *tunnel) close(reason string) {
+	t.closeOnce.Do(func() {
+		t.reason = reason
+		close(t.done)
+		t.client.Close()
+		t.server.Close()
+	})
+}
+
+func (t *tunnel) isIdle() bool {
+	last := time.Unix(0, t.lastActive.Load())
+	return time.Since(last) >= t.timeouts.Idle
+}
+
+// copy 从 src 读取数据写入 dst，每次读写都会按照 Idle 设置超时，
+// 读超时时若另外一个方向仍有数据传输，则继续等待
+func (t *tunnel) copy(dst io.ReadWriteCloser, src io.ReadWriteCloser, upload bool) (int64, error) {
+	srcName, dstName := "server", "client"
+	limit := t.downLimit
+	if upload {
+		srcName, dstName = dstName, srcName
+		limit = t.upLimit
+	}
+	idle := t.timeouts.Idle
+	buf := make([]byte, 32*1024)
+	if limit != nil {
+		// 每次最多读取 1 秒的量，避免一次透支过多
+		buf = buf[:min(len(buf), max(int(limit.rate), 1))]
+	}
+	var total int64
+	for {
+		if idle > 0 {
+			setReadDeadline(src, time.Now().Add(idle))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !limit.wait(n, t.done) {
+				return total, net.ErrClosed
+			}
+			t.lastActive.Store(time.Now().UnixNano())
+			if idle > 0 {
+				setWriteDeadline(dst, time.Now().Add(idle))
+			}
+			wn, werr := dst.Write(buf[:n])
+			total += int64(wn)
+			if werr != nil {
+				if errors.Is(werr, os.ErrDeadlineExceeded) {
+					t.close(dstName + " write timeout")
+				} else {
+					t.close(dstName + " write failed")
+				}
+				return total, werr
+			}
+			if t.account != nil {
+				var aErr error
+				if upload {
+					aErr = t.account(int64(wn), 0)
+				} else {
+					aErr = t.account(0, int64(wn))
+				}
+				if aErr != nil {
+					t.close(aErr.Error())
+					return total, aErr
+				}
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && idle > 0 {
+			if !t.isIdle() {
+				continue
+			}
+			t.close(tunnelCloseIdle)
+			return total, err
+		}
+		if errors.Is(err, io.EOF) {
+			t.close(srcName + " closed")
+			return total, nil
+		}
+		t.close(srcName + " read failed")
+		return total, err
+	}
+}
+
+// run 开始转发，直到任意一方关闭、超时或者 ctx 取消，返回关闭的原因
+func (t *tunnel) run(ctx context.Context) string {
+	t.done = make(chan struct{})
+	t.lastActive.Store(time.Now().UnixNano())
+	if t.timeouts.MaxLifetime > 0 {
+		timer := time.AfterFunc(t.timeouts.MaxLifetime, func() {
+			t.close(tunnelCloseMaxLifetime)
+		})
+		defer timer.Stop()
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		n, e := t.copy(t.client, t.server, false)
+		t.down = n
+		xlog.AddAttr(ctx, xlog.Int64("CopyToClientN", n), xlog.ErrorAttr("CopyToClientErr", e))
+	})
+	wg.Go(func() {
+		n, e := t.copy(t.server, t.client, true)
+		t.up = n
+		xlog.AddAttr(ctx, xlog.Int64("CopyToServerN", n), xlog.ErrorAttr("CopyToServerErr", e))
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.close(tunnelCloseCanceled)
+		case <-done:
+		}
+	}()
+	wg.Wait()
+	close(done)
+	// 等待 close 执行完成，保证可以读取到 reason
+	t.closeOnce.Do(func() {})
+	return t.reason
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestTunnelTimeoutConfig 解析 conf/app.yml 和 conf/users.yml 中的示例
+func TestTunnelTimeoutConfig(t *testing.T) {
+	appYAML := `
+Listeners:
+  - Name: main
+    Hedge: 0
+  - Name: fast
+    Addr: "127.0.0.1:8129"
+    Hedge: 2
+    HedgeDelay: 200
+    Strategy: latency
+    TunnelIdleTimeout: 3600
+`
+	var app appConfig
+	if err := yaml.Unmarshal([]byte(appYAML), &app); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.Listeners) != 2 {
+		t.Fatalf("got %d listeners", len(app.Listeners))
+	}
+	fast := app.Listeners[1]
+	if fast.getHedgeDelay() != 200*time.Millisecond {
+		t.Fatalf("getHedgeDelay()=%s", fast.getHedgeDelay())
+	}
+
+	usersYAML := `
+Users:
+  - Name: "admin"
+    Password: "psw"
+    TunnelConnectTimeout: 5
+    TunnelIdleTimeout: 600
+    TunnelMaxLifetime: 86400
+`
+	var uc userConfig
+	if err := yaml.Unmarshal([]byte(usersYAML), &uc); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := tunnelTimeouts{Connect: 3 * time.Second, Idle: 300 * time.Second}
+	tt.merge(fast.tunnelTimeoutConfig)
+	want := tunnelTimeouts{Connect: 3 * time.Second, Idle: time.Hour}
+	if tt != want {
+		t.Fatalf("got %+v, want %+v", tt, want)
+	}
+	tt.merge(uc.Users[0].tunnelTimeoutConfig)
+	want = tunnelTimeouts{Connect: 5 * time.Second, Idle: 10 * time.Minute, MaxLifetime: 24 * time.Hour}
+	if tt != want {
+		t.Fatalf("got %+v, want %+v", tt, want)
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/xanygo/anygo/xlog"
+)
+
+// isUpgradeRequest 是否协议升级的请求，如 WebSocket
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyUpgradeHeaders 复制协议升级（WebSocket 握手）需要的 Header
+func copyUpgradeHeaders(dst, src http.Header) {
+	dst.Set("Connection", "Upgrade")
+	dst.Set("Upgrade", src.Get("Upgrade"))
+	for k, vs := range src {
+		if !strings.HasPrefix(http.CanonicalHeaderKey(k), "Sec-Websocket-") {
+			continue
+		}
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// websocketToHTTPURL 将 ws:// 和 wss:// 的地址转换为 http:// 和 https://
+func websocketToHTTPURL(urlStr string) string {
+	switch {
+	case strings.HasPrefix(urlStr, "ws://"):
+		return "http://" + urlStr[len("ws://"):]
+	case strings.HasPrefix(urlStr, "wss://"):
+		return "https://" + urlStr[len("wss://"):]
+	default:
+		return urlStr
+	}
+}
+
+// forwardUpgrade 转发协议升级的请求：通过代理完成升级后，劫持客户端的连接，
+// 和 handleConnect 一样双向的转发数据
+func (hc *reply) forwardUpgrade(ctx context.Context, w http.ResponseWriter, param forwardParam, tt tunnelTimeouts) {
+	if param.Body != nil {
+		defer param.Body.Close()
+	}
+	release, err := waitDomainLimit(ctx, param.Request.URL.Hostname())
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "waitDomainLimit"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer release()
+
+	var p *proxyEntry
+	var resp *http.Response
+	var i int
+	var tier filterTier
+	tiers := getFilterTiers(param.Filter)
+	total := tiers.total(param.Attempt)
+	for i = 0; i < total; i++ {
+		hc.usedTotal.Add(1)
+		param.lastTry = i == total-1
+		tier = tiers.at(i, param.Attempt)
+		p, err = tier.pick(ctx)
+		if err != nil {
+			xlog.Warn(ctx, "getOneProxyActive failed", xlog.ErrorAttr("Error", err), xlog.String("Tier", tier.Name))
+			i = tiers.skip(i, param.Attempt)
+			continue
+		}
+		resp, err = hc.doRequest(ctx, param, p)
+		if err == nil {
+			break
+		}
+		xlog.Warn(ctx, "upgrade request failed", xlog.ErrorAttr("Error", err), xlog.String("Proxy", p.Base.Proxy))
+	}
+	if tier.Name != "" {
+		xlog.AddAttr(ctx, xlog.String("Tier", tier.Name))
+		w.Header().Set("X-Man-Tier", tier.Name)
+	}
+
+	if resp == nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "forwardUpgrade"))
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("upgrade request failed (attempt %d): %v", i, err)))
+		return
+	}
+	defer resp.Body.Close()
+	xlog.AddAttr(ctx, xlog.String("Upgrade", param.Request.Header.Get("Upgrade")), xlog.Int("UpgradeStatus", resp.StatusCode))
+
+	w.Header().Set("X-Man-Attempt", fmt.Sprintf("%d/%d", i, total))
+	w.Header().Set("X-Man-Via", p.Base.URL.Hostname())
+
+	// 上游没有同意升级，按照普通的响应返回
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		rd, err := limitResponseBody(resp)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		copyProxyResponseHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		writeResponseBody(w, rd)
+		return
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		xlog.AddAttr(ctx, xlog.String("Error", fmt.Sprintf("%T not io.ReadWriteCloser", resp.Body)))
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream does not support upgrade"))
+		return
+	}
+
+	conn, err := hc.getClientConn(w)
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "getClientConn"))
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("can not hijack"))
+		return
+	}
+	defer conn.Close()
+
+	// 响应 Header 需要原样返回，如 Sec-WebSocket-Accept
+	header := resp.Header.Clone()
+	for k, vs := range w.Header() {
+		header[k] = vs
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 %s\r\n", resp.Status)
+	if err == nil {
+		err = header.Write(conn)
+	}
+	if err == nil {
+		_, err = io.WriteString(conn, "\r\n")
+	}
+	if err != nil {
+		xlog.AddAttr(ctx, xlog.ErrorAttr("Error", err), xlog.String("Action", "send Switching Protocols"))
+		return
+	}
+	tk := newTrafficKey(ctx, param.Username, p, param.Request.URL.Hostname())
+	tk.Tier = tier.Name
+	hc.pipe(ctx, conn, p, backConn, tt, tk)
+	hc.usedSuccess.Add(1)
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// userOptions 通过代理用户名传递的路由参数，用于只能设置代理地址、不能设置 HTTP Header 的客户端
+//
+//	格式：{user}-{key}-{value}-{key}-{value}...，如 alice-tag-us+residential-session-abc123-retry-3
+//	tag:     筛选代理的 Tags，+ 表示同时满足，多个 tag 参数表示满足其一即可，同 [X-Man-Filter]
+//	session: 会话 ID，同 [X-Man-Session]
+//	retry:   重试次数，同 [X-Man-Retry]
+//	hedge:   对冲请求数，同 [X-Man-Hedge]
+//	format:  输出格式，同 [X-Man-Format]
+//	strategy: 代理的选择策略，同 [X-Man-Strategy]
+//
+// HTTP Header 的优先级高于用户名中的参数
+type userOptions struct {
+	Filter  string
+	Session string
+	Retry   int
+	Hedge   int
+	Format  string
+
+	Strategy string
+}
+
+func (uo userOptions) IsZero() bool {
+	return uo == userOptions{}
+}
+
+// parseProxyUserName 解析代理用户名，返回实际的用户名和路由参数，
+// 若格式不正确，则将整个作为用户名
+func parseProxyUserName(name string) (string, userOptions) {
+	var opts userOptions
+	parts := strings.Split(name, "-")
+	start := -1
+	for i := 1; i < len(parts); i++ {
+		if isUserOptionKey(parts[i]) {
+			start = i
+			break
+		}
+	}
+	if start < 0 || (len(parts)-start)%2 != 0 {
+		return name, opts
+	}
+	var tags []string
+	for i := start; i < len(parts); i += 2 {
+		key, value := parts[i], parts[i+1]
+		if value == "" {
+			return name, userOptions{}
+		}
+		switch key {
+		case "tag":
+			tags = append(tags, strings.ReplaceAll(value, "+", "&"))
+		case "session":
+			opts.Session = value
+		case "retry":
+			num, err := strconv.Atoi(value)
+			if err != nil {
+				return name, userOptions{}
+			}
+			opts.Retry = num
+		case "hedge":
+			num, err := strconv.Atoi(value)
+			if err != nil {
+				return name, userOptions{}
+			}
+			opts.Hedge = num
+		case "format":
+			opts.Format = value
+		case "strategy":
+			opts.Strategy = value
+		default:
+			return name, userOptions{}
+		}
+	}
+	opts.Filter = strings.Join(tags, ",")
+	return strings.Join(parts[:start], "-"), opts
+}
+
+func isUserOptionKey(key string) bool {
+	switch key {
+	case "tag", "session", "retry", "hedge", "format", "strategy":
+		return true
+	default:
+		return false
+	}
+}
+
+// getFilterWithRequest 筛选代理的条件，客户端通过 HTTP Header [X-Man-Filter] 或者代理用户名指定
+func getFilterWithRequest(req *http.Request, user *User) string {
+	if str := req.Header.Get("X-Man-Filter"); str != "" {
+		return str
+	}
+	if user != nil {
+		return user.Options.Filter
+	}
+	return ""
+}
+
+// getFormatWithRequest 输出格式，客户端通过 HTTP Header [X-Man-Format] 或者代理用户名指定
+func getFormatWithRequest(req *http.Request, user *User) string {
+	if str := req.Header.Get("X-Man-Format"); str != "" {
+		return str
+	}
+	if user != nil {
+		return user.Options.Format
+	}
+	return ""
+}
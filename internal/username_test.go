@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestParseProxyUserName(t *testing.T) {
+	tests := []struct {
+		name     string
+		wantName string
+		wantOpts userOptions
+	}{
+		{name: "alice", wantName: "alice"},
+		{name: "", wantName: ""},
+		{name: "my-name", wantName: "my-name"},
+
+		{name: "alice-tag-us", wantName: "alice", wantOpts: userOptions{Filter: "us"}},
+		{name: "alice-tag-us+residential", wantName: "alice", wantOpts: userOptions{Filter: "us&residential"}},
+		{name: "alice-session-abc123", wantName: "alice", wantOpts: userOptions{Session: "abc123"}},
+		{name: "alice-retry-3", wantName: "alice", wantOpts: userOptions{Retry: 3}},
+		{name: "alice-hedge-2", wantName: "alice", wantOpts: userOptions{Hedge: 2}},
+		{name: "alice-format-json", wantName: "alice", wantOpts: userOptions{Format: "json"}},
+		{name: "alice-strategy-latency", wantName: "alice", wantOpts: userOptions{Strategy: "latency"}},
+		{
+			name:     "my-name-tag-us+residential-session-abc123-retry-3",
+			wantName: "my-name",
+			wantOpts: userOptions{Filter: "us&residential", Session: "abc123", Retry: 3},
+		},
+
+		// 重复的参数：tag 为满足其一，其他的使用最后一个
+		{name: "alice-tag-us-tag-de", wantName: "alice", wantOpts: userOptions{Filter: "us,de"}},
+		{name: "alice-session-a-session-b", wantName: "alice", wantOpts: userOptions{Session: "b"}},
+		{name: "alice-retry-1-retry-2", wantName: "alice", wantOpts: userOptions{Retry: 2}},
+
+		// 格式不正确的，整个作为用户名
+		{name: "alice-session", wantName: "alice-session"},
+		{name: "alice-session-", wantName: "alice-session-"},
+		{name: "alice-session--retry-1", wantName: "alice-session--retry-1"},
+		{name: "alice-retry-x", wantName: "alice-retry-x"},
+		{name: "alice-hedge-1.5", wantName: "alice-hedge-1.5"},
+		{name: "alice-session-a-foo-b", wantName: "alice-session-a-foo-b"},
+		{name: "alice-session-a-retry", wantName: "alice-session-a-retry"},
+		{name: "tag-us", wantName: "tag-us"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, opts := parseProxyUserName(tt.name)
+			if name != tt.wantName {
+				t.Errorf("name=%q, want %q", name, tt.wantName)
+			}
+			if opts != tt.wantOpts {
+				t.Errorf("opts=%+v, want %+v", opts, tt.wantOpts)
+			}
+		})
+	}
+}
+
+func TestGetProxyAuthorInfo(t *testing.T) {
+	tests := []struct {
+		auth     string // 用户名:密码
+		wantName string
+		wantPsw  string
+		wantOpts userOptions
+	}{
+		{auth: "alice:psw", wantName: "alice", wantPsw: "psw"},
+		// 密码中的 - 和 : 不影响用户名中的参数
+		{auth: "alice-session-abc:p-a:ss-tag-x", wantName: "alice", wantPsw: "p-a:ss-tag-x", wantOpts: userOptions{Session: "abc"}},
+		{auth: "alice-tag-us:", wantName: "alice", wantPsw: "", wantOpts: userOptions{Filter: "us"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header.Set(proxyAuthorizationHeader, "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.auth)))
+			user := getProxyAuthorInfo(req)
+			if user.Name != tt.wantName {
+				t.Errorf("Name=%q, want %q", user.Name, tt.wantName)
+			}
+			if user.PasswordMd5 != StrMd5(tt.wantPsw) {
+				t.Errorf("password mismatch, want %q", tt.wantPsw)
+			}
+			if user.Options != tt.wantOpts {
+				t.Errorf("Options=%+v, want %+v", user.Options, tt.wantOpts)
+			}
+		})
+	}
+}
@@ -1,13 +1,14 @@
 package internal
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
+	"maps"
 	"math"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"runtime"
 	"slices"
@@ -20,7 +21,6 @@ import (
 	"github.com/xanygo/anygo/ds/xslice"
 	"github.com/xanygo/anygo/ds/xsync"
 	"github.com/xanygo/anygo/ds/xurl"
-	"github.com/xanygo/anygo/safely"
 	"github.com/xanygo/anygo/xattr"
 	"github.com/xanygo/anygo/xhttp"
 	"github.com/xanygo/anygo/xio/xfs"
@@ -106,10 +106,33 @@ func (aw *adminWeb) init() {
 	aw.router.GetFunc("/clean", aw.handleClean)
 	aw.router.GetFunc("/cancel", aw.handleCancel)
 	aw.router.GetFunc("/start_check", aw.handleStartCheck)
+	aw.router.GetFunc("/checker", aw.handleChecker)
+
+	aw.router.GetFunc("/route", aw.handleRoute)
+
+	aw.router.GetFunc("/geoip", aw.handleGeoIP)
+	aw.router.GetFunc("/geoip/reload", aw.handleGeoIPReload)
+
+	aw.router.GetFunc("/traffic", aw.handleTraffic)
+
+	aw.router.GetFunc("/ca", aw.handleCA)
+	aw.router.GetFunc("/ca.crt", aw.handleCACert)
+
+	aw.router.GetFunc("/sessions", aw.handleSessions)
+	aw.router.GetFunc("/sessions/rotate", aw.handleSessionRotate)
+
+	aw.router.GetFunc("/breaker/reset", aw.handleBreakerReset)
+	aw.router.GetFunc("/restore", aw.handleRestore)
+	aw.router.GetFunc("/proxy", aw.handleProxyDetail)
+
+	aw.router.GetFunc("/reputation", aw.handleReputation)
+	aw.router.GetFunc("/events", aw.handleEvents)
 
 	// 支持多种 Method
 	aw.router.HandleFunc("/fetch", aw.handleFetch)   // 通过代理访问
 	aw.router.HandleFunc("/direct", aw.handleDirect) // 直接访问
+	aw.router.HandleFunc("/echo", aw.handleEcho)     // 返回请求方的 IP 和 Header
+	aw.router.GetFunc("/fetch/ws", aw.handleFetchWS) // 通过代理访问 WebSocket
 
 	aw.router.GetFunc("/", aw.handleIndex)
 }
@@ -207,9 +230,14 @@ func (aw *adminWeb) getWebCtx(ctx context.Context) *webCtx {
 }
 
 func (aw *adminWeb) handleIndex(w http.ResponseWriter, req *http.Request) {
-	values := aw.getWebCtx(req.Context()).values
+	wc := aw.getWebCtx(req.Context())
+	values := wc.values
+	if wc.isLogin {
+		values["Quota"] = getQuotaUsage(wc.userName())
+	}
 	usedTotal := defaultRelay.usedTotal.Load()
 	usedSuccess := defaultRelay.usedSuccess.Load()
+	due, lag := pool.checkBacklog()
 
 	status := []KV{
 		{Key: "Server Start", Value: xattr.StartTime().Format(timeFormatStd)},
@@ -224,6 +252,8 @@ func (aw *adminWeb) handleIndex(w http.ResponseWriter, req *http.Request) {
 
 		{Key: "Checker Probe URL", Value: getProbeURL()},
 		{Key: "Checker Producer Running", Value: producerRunning.Load()},
+		{Key: "Checker Due / Lag", Value: fmt.Sprintf("%d / %s", due, lag.Round(time.Second))},
+		{Key: "Checker Queue / InFlight", Value: fmt.Sprintf("%d / %d", pool.checker.Len(), pool.checker.inFlight.Load())},
 		{Key: "Checker Last Check", Value: lastChecked.Load()},
 	}
 
@@ -232,16 +262,26 @@ func (aw *adminWeb) handleIndex(w http.ResponseWriter, req *http.Request) {
 	}
 
 	values["Status"] = status
+	values["Rules"] = routes.All()
+	values["Traffic"] = []KV{
+		{Key: "User", Value: traffic.List(trafficGroupUser, 0)},
+		{Key: "Listener", Value: traffic.List(trafficGroupListener, 0)},
+		{Key: "Domain (Top 20)", Value: traffic.List(trafficGroupDomain, 20)},
+		{Key: "Tier", Value: traffic.List(trafficGroupTier, 0)},
+	}
 
 	active := pool.active.All()
 	slices.SortFunc(active, sortChain)
 	values["active"] = active
 	all := pool.all.All()
 	other := xslice.Filter(all, func(index int, item *proxyEntry, okTotal int) bool {
-		return !item.IsOk()
+		return pool.active.Get(item.Base.Proxy) == nil && item.LifecycleState() != stateQuarantined
 	})
 	slices.SortFunc(other, sortChain)
 	values["other"] = other
+	quarantined := pool.quarantined()
+	slices.SortFunc(quarantined, sortChain)
+	values["quarantined"] = quarantined
 
 	code := renderHTML("index.html", values, true)
 	_, _ = w.Write(code)
@@ -279,11 +319,12 @@ func (aw *adminWeb) handleAddPost(w http.ResponseWriter, req *http.Request) {
 	})
 
 	if len(added) > 0 {
-		go safely.Run(func() {
-			for _, p := range added {
-				pool.checkerJobs <- p
+		// 新添加的代理会优先检查，队列已满时由调度加入
+		for _, p := range added {
+			if !pool.checker.Submit(p) {
+				break
 			}
-		})
+		}
 	}
 
 	_, _ = fmt.Fprintf(w, "<script>alert('add %d new proxy');</script>", len(added))
@@ -311,23 +352,36 @@ func (aw *adminWeb) handleLogout(w http.ResponseWriter, req *http.Request) {
 func (aw *adminWeb) handleStatus(w http.ResponseWriter, _ *http.Request) {
 	usedTotal := defaultRelay.usedTotal.Load()
 	usedSuccess := defaultRelay.usedSuccess.Load()
+	due, lag := pool.checkBacklog()
+	checker := pool.checker.Status()
+	maps.Copy(checker, map[string]any{
+		"ProbeURL":    getProbeURL(),
+		"Probes":      probes,
+		"ProbeQuorum": xattr.GetDefault[int]("ProbeQuorum", 0),
+		"EchoURL":     getEchoURL(),
+		"Interval":    getCheckInterval().String(),
+		"MaxInterval": getCheckMaxInterval().String(),
+		"Due":         due,
+		"Lag":         lag.Round(time.Second).String(),
+	})
 	values := map[string]any{
 		"StartTime": xattr.StartTime().Format(timeFormatStd),
 		"Version":   version,
-		"Checker": map[string]any{
-			"ProbeURL":     getProbeURL(),
-			"Interval":     getCheckInterval().String(),
-			"BufferedJobs": len(pool.checkerJobs),
-		},
+		"Checker":   checker,
 		"Counter": map[string]any{
 			"ActiveProxies": pool.active.Total(),
 			"TotalProxies":  pool.all.Total(),
 			"DynProxies":    pool.dyn.Total(),
+			"Sessions":      sessions.Len(),
 
 			"UsageTotal":   usedTotal,
 			"UsageSuccess": usedSuccess,
 			"UsageFail":    usedTotal - usedSuccess,
 		},
+		"GeoIP":        geoIP.Files(),
+		"Limits":       requestLimitsUsage(),
+		"Tiers":        traffic.List(trafficGroupTier, 0),
+		"SharedExitIP": exitIPs.Shared(),
 		"Timeout":      getProxyTimeout().String(),
 		"NumGoroutine": runtime.NumGoroutine(),
 	}
@@ -402,11 +456,17 @@ func (aw *adminWeb) handleTestPost(w http.ResponseWriter, req *http.Request) {
 		wc.addLogMsg("failed, url=", urlStr, ",err=", err)
 		return
 	}
-	testResult = true
 	defer resp.Body.Close()
+	rd, err := limitResponseBody(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	testResult = true
 	copyProxyResponseHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	_, _ = writeResponseBody(w, rd)
 }
 
 func (aw *adminWeb) handleLoginGet(w http.ResponseWriter, req *http.Request) {
@@ -450,6 +510,17 @@ func (aw *adminWeb) handleFetch(w http.ResponseWriter, req *http.Request) {
 		notLoginHandler(w, req)
 		return
 	}
+	if err := checkUserQuota(wc.userName()); err != nil {
+		writeQuotaExceeded(w, err)
+		return
+	}
+	release, err := acquireUserLimit(req.Context(), wc.userName())
+	if err != nil {
+		writeTooManyRequests(w, err)
+		return
+	}
+	defer release()
+
 	qs := req.URL.Query()
 	queryURL := qs.Get("url")
 	if len(queryURL) == 0 {
@@ -457,13 +528,19 @@ func (aw *adminWeb) handleFetch(w http.ResponseWriter, req *http.Request) {
 		_, _ = w.Write([]byte("url param is required"))
 		return
 	}
-	body, err := io.ReadAll(req.Body)
+	// 确保即使重试，body 也能正常的转发
+	body, err := newReplayBody(w, req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		_, _ = w.Write([]byte("read body err:" + err.Error()))
 		return
 	}
 
+	upgrade := isUpgradeRequest(req)
+	if upgrade {
+		queryURL = websocketToHTTPURL(queryURL)
+	}
+
 	method := xurl.StringDef(qs, "method", req.Method)
 	request, err := http.NewRequestWithContext(req.Context(), strings.ToUpper(method), queryURL, nil)
 	if err != nil {
@@ -471,9 +548,9 @@ func (aw *adminWeb) handleFetch(w http.ResponseWriter, req *http.Request) {
 		_, _ = w.Write([]byte("build request failed: " + err.Error()))
 		return
 	}
-	// 确保即使重试，body 也能正常的转发
-	request.GetBody = func() (io.ReadCloser, error) {
-		return io.NopCloser(bytes.NewReader(body)), nil
+	request.ContentLength = req.ContentLength
+	if upgrade {
+		copyUpgradeHeaders(request.Header, req.Header)
 	}
 
 	header := qs.Get("header")
@@ -493,20 +570,72 @@ func (aw *adminWeb) handleFetch(w http.ResponseWriter, req *http.Request) {
 	}
 	filter := qs.Get("filter")
 	if filter == "" {
-		filter = req.Header.Get("X-Man-Filter")
+		filter = getFilterWithRequest(req, nil)
+	}
+	if ctxProxy, _ := req.Context().Value(ctxKeyUseProxy).(*proxyEntry); ctxProxy == nil {
+		// 通过 /direct 访问时，不需要匹配路由规则
+		host, port, err := getHostPortFromURL(queryURL)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid url: " + err.Error()))
+			return
+		}
+		ctx, ruleFilter, err := applyRoute(req.Context(), newRouteTarget(req.Context(), host, port, wc.userName()), filter)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		filter = ruleFilter
+		req = req.WithContext(ctx)
+		request = request.WithContext(ctx)
+	}
+	if err = checkFilter(filter); err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	if id := xurl.StringDef(qs, "session", getSessionWithRequest(req, nil)); id != "" {
+		ctx := contextWithSession(req.Context(), sessions.Get(wc.userName(), id))
+		req = req.WithContext(ctx)
+		request = request.WithContext(ctx)
 	}
-	attempt := xurl.IntDef(qs, "retry", getRetryWithRequest(req)) + 1
+	strategy := getStrategyWithRequest(req, nil)
+	if s, ok := getStrategy(qs.Get("strategy")); ok {
+		strategy = s
+	}
+	xlog.AddAttr(req.Context(), xlog.String("Strategy", strategy.Name()))
+	req = req.WithContext(contextWithStrategy(req.Context(), strategy))
+	request = request.WithContext(req.Context())
+
+	attempt := xurl.IntDef(qs, "retry", getRetryWithRequest(req, nil)) + 1
 	param := forwardParam{
 		Request:  request,
+		Body:     body,
 		Username: wc.userName(),
 		Filter:   filter,
 		Attempt:  max(attempt, 1),
-		Format:   xurl.StringDef(qs, "format", req.Header.Get("X-Man-Format")),
+		Hedge:    min(xurl.IntDef(qs, "hedge", getHedgeWithRequest(req, nil)), getHedgeMax()),
+		Format:   xurl.StringDef(qs, "format", getFormatWithRequest(req, nil)),
 	}
 
+	if upgrade {
+		defaultRelay.forwardUpgrade(req.Context(), w, param, getTunnelTimeouts(req.Context(), wc.user))
+		return
+	}
 	defaultRelay.forwardRequest(req.Context(), w, param)
 }
 
+// handleFetchWS 通过代理访问 WebSocket，客户端连接 ws://{admin}/fetch/ws?url=wss://example.com/ws ，
+// 参数同 /fetch
+func (aw *adminWeb) handleFetchWS(w http.ResponseWriter, req *http.Request) {
+	if !isUpgradeRequest(req) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("websocket upgrade request is required"))
+		return
+	}
+	aw.handleFetch(w, req)
+}
+
 // handlePick 获取一个代理服务器
 func (aw *adminWeb) handlePick(w http.ResponseWriter, req *http.Request) {
 	wc := aw.getWebCtx(req.Context())
@@ -519,13 +648,22 @@ func (aw *adminWeb) handlePick(w http.ResponseWriter, req *http.Request) {
 		wc.addLogMsg("auth failed")
 		return
 	}
-	one, err := pool.getOneProxyActive(req.Context(), req.URL.Query().Get("filter"))
+	ctx := req.Context()
+	if s, ok := getStrategy(req.URL.Query().Get("strategy")); ok {
+		ctx = contextWithStrategy(ctx, s)
+	}
+	one, err := pool.getOneProxyActive(ctx, req.URL.Query().Get("filter"))
 	if err != nil {
 		data := map[string]any{
 			"Code": 2,
 			"Msg":  err.Error(),
 		}
-		writeJSON(w, http.StatusBadGateway, data)
+		status := http.StatusBadGateway
+		if isFilterError(err) {
+			data["Code"] = 1
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, data)
 		wc.addLogMsg("fetch failed:", err.Error())
 		return
 	}
@@ -568,10 +706,344 @@ func (aw *adminWeb) handleStartCheck(w http.ResponseWriter, req *http.Request) {
 		notLoginHandler(w, req)
 		return
 	}
-	go pool.startCheckProducer()
+	go pool.checkAllNow()
 	w.Write([]byte("Ok"))
 }
 
+// handleChecker 查看和修改检查的并发数、队列长度和超时（秒），如 /checker?workers=32&queue=10000&timeout=10 ，
+// 修改只在本次运行中有效
+func (aw *adminWeb) handleChecker(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	qs := req.URL.Query()
+	if qs.Has("workers") || qs.Has("queue") || qs.Has("timeout") {
+		cfg := pool.checker.Config()
+		cfg.Workers = xurl.IntDef(qs, "workers", cfg.Workers)
+		cfg.QueueSize = xurl.IntDef(qs, "queue", cfg.QueueSize)
+		cfg.Timeout = time.Duration(xurl.IntDef(qs, "timeout", int(cfg.Timeout/time.Second))) * time.Second
+		if err := pool.checker.SetConfig(cfg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"Code": 1, "Msg": err.Error()})
+			return
+		}
+		wc.addLogMsg("checker config:", cfg.Workers, cfg.QueueSize, cfg.Timeout)
+	}
+	writeJSON(w, http.StatusOK, pool.checker.Status())
+}
+
+// handleRoute 调试路由规则，查看一个目标地址会匹配哪个规则
+//
+//	/route?target=example.com:443&user=alice&listener=main
+func (aw *adminWeb) handleRoute(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isLogin {
+		notLoginHandler(w, req)
+		return
+	}
+	qs := req.URL.Query()
+	target := strings.TrimSpace(qs.Get("target"))
+	if target == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"Code": 1, "Msg": "target param is required"})
+		return
+	}
+	var host string
+	var port int
+	var err error
+	if strings.Contains(target, "://") {
+		host, port, err = getHostPortFromURL(target)
+	} else {
+		host, port, err = parseHostPort(target)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"Code": 1, "Msg": "invalid target: " + err.Error()})
+		return
+	}
+	ctx := req.Context()
+	if name := qs.Get("listener"); name != "" {
+		ctx = contextWithListener(ctx, &listenerConfig{Name: name})
+	}
+	user := xurl.StringDef(qs, "user", wc.userName())
+	data := routeDecision(ctx, newRouteTarget(ctx, host, port, user))
+	data["Code"] = 0
+	writeJSON(w, http.StatusOK, data)
+}
+
+// handleGeoIP 查询 IP 的国家和 ASN，ip 为空时返回数据库信息
+func (aw *adminWeb) handleGeoIP(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isLogin {
+		notLoginHandler(w, req)
+		return
+	}
+	ipStr := strings.TrimSpace(req.URL.Query().Get("ip"))
+	if ipStr == "" {
+		writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Files": geoIP.Files()})
+		return
+	}
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"Code": 1, "Msg": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Data": geoIP.Lookup(addr)})
+}
+
+// handleGeoIPReload 重新加载 GeoIP 数据库文件
+func (aw *adminWeb) handleGeoIPReload(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	if err := geoIP.Reload(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"Code": 1, "Msg": err.Error(), "Files": geoIP.Files()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Files": geoIP.Files()})
+}
+
+// handleTraffic 流量统计，group 为 user、proxy、domain、listener、tier 之一，为空时返回所有分组
+func (aw *adminWeb) handleTraffic(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	qs := req.URL.Query()
+	limit := xurl.IntDef(qs, "limit", 0)
+	group := qs.Get("group")
+	if group != "" {
+		if !slices.Contains(trafficGroups, group) {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"Code": 1, "Msg": "invalid group: " + group})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Data": traffic.List(group, limit)})
+		return
+	}
+	data := make(map[string][]trafficItem, len(trafficGroups))
+	for _, g := range trafficGroups {
+		data[g] = traffic.List(g, limit)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Data": data})
+}
+
+// handleCA HTTPS 解密（MITM）使用的 CA 证书的下载和安装说明页面
+func (aw *adminWeb) handleCA(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	ca, ok := loadMITMCAForWeb(w, req)
+	if !ok {
+		return
+	}
+	values := wc.values
+	values["Subject"] = ca.cert.Subject.String()
+	values["NotAfter"] = ca.cert.NotAfter
+	values["Fingerprint"] = fmt.Sprintf("%X", sha256.Sum256(ca.cert.Raw))
+	code := renderHTML("ca.html", values, true)
+	_, _ = w.Write(code)
+}
+
+// handleCACert 下载 CA 证书，证书是公开的，不需要登录
+func (aw *adminWeb) handleCACert(w http.ResponseWriter, req *http.Request) {
+	ca, ok := loadMITMCAForWeb(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="proxy-manager-ca.crt"`)
+	_, _ = w.Write(ca.certPEM)
+}
+
+// loadMITMCAForWeb 未开启 HTTPS 解密时返回 404，根证书不可用时返回 500
+func loadMITMCAForWeb(w http.ResponseWriter, req *http.Request) (*mitmCA, bool) {
+	if !isMITMConfigured() {
+		http.Error(w, "MITM is not enabled", http.StatusNotFound)
+		return nil, false
+	}
+	ca, err := mitmCAStore.Load()
+	if err != nil {
+		xlog.AddAttr(req.Context(), xlog.ErrorAttr("Error", err))
+		http.Error(w, "MITM CA is unavailable", http.StatusInternalServerError)
+		return nil, false
+	}
+	return ca, true
+}
+
+// handleSessions 会话保持的列表
+func (aw *adminWeb) handleSessions(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	var items []map[string]any
+	for _, s := range sessions.All() {
+		items = append(items, s.Info())
+	}
+	if req.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	values := wc.values
+	values["sessions"] = items
+	values["SessionTTL"] = getSessionTTL().String()
+	code := renderHTML("sessions.html", values, true)
+	_, _ = w.Write(code)
+}
+
+// handleSessionRotate 强制会话切换代理，key 为空时切换所有的会话
+func (aw *adminWeb) handleSessionRotate(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	key := req.URL.Query().Get("key")
+	var list []*stickySession
+	if key == "" {
+		list = sessions.All()
+	} else if s := sessions.Lookup(key); s != nil {
+		list = append(list, s)
+	}
+	var rotated int
+	for _, s := range list {
+		if err := s.Rotate(pool.active); err != nil {
+			wc.addLogMsg("rotate ", s.Key, " failed: ", err)
+			continue
+		}
+		rotated++
+	}
+	wc.addLogMsg("rotate sessions:", rotated)
+	http.Redirect(w, req, "/sessions", http.StatusFound)
+}
+
+// handleBreakerReset 手动恢复代理的熔断器，proxy 为空时恢复所有的
+func (aw *adminWeb) handleBreakerReset(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	proxyURL := req.URL.Query().Get("proxy")
+	var list []*proxyEntry
+	if proxyURL == "" {
+		list = pool.all.All()
+	} else if one := pool.all.Get(proxyURL); one != nil {
+		list = append(list, one)
+	}
+	var reset int
+	for _, one := range list {
+		if one.State.Breaker.State() != breakerClosed {
+			one.State.Breaker.Reset()
+			reset++
+		}
+	}
+	wc.addLogMsg("reset breakers:", reset)
+	if req.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Reset": reset})
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+// handleEvents 最近的代理事件，可使用 type 筛选类型
+func (aw *adminWeb) handleEvents(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	typ := strings.TrimSpace(req.URL.Query().Get("type"))
+	limit := xurl.IntDef(req.URL.Query(), "limit", 100)
+	writeJSON(w, http.StatusOK, events.List(typ, limit))
+}
+
+// handleRestore 手动恢复代理，恢复后立即检查，proxy 为空时恢复所有 quarantined 的
+func (aw *adminWeb) handleRestore(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	proxyURL := req.URL.Query().Get("proxy")
+	var list []*proxyEntry
+	if proxyURL == "" {
+		list = pool.quarantined()
+	} else if one := pool.all.Get(proxyURL); one != nil {
+		list = append(list, one)
+	}
+	for _, one := range list {
+		pool.restoreProxy(one)
+	}
+	wc.addLogMsg("restore proxies:", len(list))
+	if req.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, map[string]any{"Code": 0, "Restored": len(list)})
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+// handleProxyDetail 代理的详情：最近的检查和转发结果，可用率和耗时的分位数
+func (aw *adminWeb) handleProxyDetail(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	one := pool.all.Get(req.URL.Query().Get("proxy"))
+	if one == nil {
+		writeJSON(w, http.StatusNotFound, map[string]any{"Code": 1, "Msg": "proxy not found"})
+		return
+	}
+	history := one.State.History.List()
+	data := map[string]any{
+		"Proxy":   one.Base.Proxy,
+		"State":   one.LifecycleState(),
+		"Summary": summarizeHistory(history),
+		"History": history,
+	}
+	if req.URL.Query().Get("format") == "json" {
+		data["Code"] = 0
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+	values := wc.values
+	values["data"] = data
+	values["proxy"] = one
+	values["sparkline"] = newSparkline(history, 800, 80)
+	slices.Reverse(history)
+	code := renderHTML("proxy.html", values, true)
+	_, _ = w.Write(code)
+}
+
+// handleReputation 代理在目标域名上的信誉，domain 为空时列出所有有记录的域名
+func (aw *adminWeb) handleReputation(w http.ResponseWriter, req *http.Request) {
+	wc := aw.getWebCtx(req.Context())
+	if !wc.isAdmin() {
+		notLoginHandler(w, req)
+		return
+	}
+	domain := strings.TrimSpace(req.URL.Query().Get("domain"))
+	data := map[string]any{
+		"Domain": registrableDomain(domain),
+	}
+	if domain == "" {
+		data["Domains"] = reputation.Domains()
+	} else {
+		data["Proxies"] = reputation.Proxies(domain)
+	}
+	if req.URL.Query().Get("format") == "json" {
+		data["Code"] = 0
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+	values := wc.values
+	values["data"] = data
+	code := renderHTML("reputation.html", values, true)
+	_, _ = w.Write(code)
+}
+
 func notLoginHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusBadRequest)
 	_, _ = w.Write([]byte("proxy auth failed"))
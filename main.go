@@ -26,6 +26,6 @@ func init() {
 func main() {
 	flag.Parse()
 	xattr.MustInitAppMain(*c, xcfg.Parse)
-	internal.Setup()
+	internal.Setup(*c)
 	internal.Start()
 }